@@ -0,0 +1,144 @@
+package elasticwg
+
+import (
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"sync"
+)
+
+// ackTracker follows the acknowledgement of documents numbered by increasing sequence numbers
+// The committed sequence is the highest one whose documents up to it are all acknowledged, documents
+// being acknowledged out of order by the consumers
+type ackTracker struct {
+	mu        sync.Mutex
+	committed uint64
+	acked     map[uint64]struct{}
+	onCommit  func(committed uint64)
+}
+
+// newAckTracker returns a tracker whose documents up to committed are already acknowledged
+// onCommit is called with the new committed sequence each time it advances
+func newAckTracker(committed uint64, onCommit func(committed uint64)) *ackTracker {
+	return &ackTracker{
+		committed: committed,
+		acked:     map[uint64]struct{}{},
+		onCommit:  onCommit,
+	}
+}
+
+// ack acknowledges the documents seqs, 0 being a document not tracked
+func (t *ackTracker) ack(seqs []uint64) {
+	if t == nil || len(seqs) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, seq := range seqs {
+		if seq > t.committed {
+			t.acked[seq] = struct{}{}
+		}
+	}
+
+	prev := t.committed
+	for {
+		if _, ok := t.acked[t.committed+1]; !ok {
+			break
+		}
+		delete(t.acked, t.committed+1)
+		t.committed++
+	}
+	if t.committed != prev && t.onCommit != nil {
+		t.onCommit(t.committed)
+	}
+}
+
+// getCommitted returns the committed sequence
+func (t *ackTracker) getCommitted() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.committed
+}
+
+// isRetryableItem returns whether Elasticsearch failed the bulk item for a transient reason, such as a full
+// write queue or an unavailable shard, the document being accepted if sent again
+func isRetryableItem(item *elastic.BulkResponseItem) bool {
+	return item.Status == http.StatusTooManyRequests || item.Status >= http.StatusInternalServerError ||
+		(item.Error != nil && item.Error.Type == rejectedExecutionException)
+}
+
+// doneSeqs returns the sequence numbers of the documents of a bulk request done with, indexed or rejected for
+// good. Documents failed for a transient reason stay unacknowledged like the ones of a bulk given up, so they
+// are sent again by the next run
+func doneSeqs(result *bulkResult) []uint64 {
+	if len(result.seqs) == 0 || len(result.res.Items) != len(result.seqs) {
+		return nil
+	}
+
+	seqs := make([]uint64, 0, len(result.seqs))
+	for i, item := range result.res.Items {
+		retryable := false
+		for _, res := range item {
+			if res != nil && isRetryableItem(res) {
+				retryable = true
+			}
+		}
+		if !retryable {
+			seqs = append(seqs, result.seqs[i])
+		}
+	}
+	return seqs
+}
+
+// AckResult the outcome of a document passed to the acknowledgement callback
+// OK tells the document is indexed, by the failover cluster if FailedOver, or left out by the incremental
+// mode if Skipped. Status is the HTTP status of the bulk item, 0 if the document wasn't sent, & Reason
+// why the document failed
+type AckResult struct {
+	ID         string
+	OK         bool
+	Status     int
+	Reason     string
+	Skipped    bool
+	FailedOver bool
+}
+
+// ackResults returns the outcome of each document of a bulk request done
+// Items are in the order of the actions, an unexpected response fails all the documents
+func ackResults(result *bulkResult) []AckResult {
+	results := make([]AckResult, len(result.tokens))
+	if len(result.res.Items) != len(result.tokens) {
+		for i := range results {
+			results[i].Reason = "unexpected bulk response"
+		}
+		return results
+	}
+
+	for i, item := range result.res.Items {
+		for _, res := range item {
+			if res == nil {
+				continue
+			}
+			results[i] = AckResult{
+				ID:         res.Id,
+				OK:         res.Status >= http.StatusOK && res.Status < http.StatusMultipleChoices,
+				Status:     res.Status,
+				FailedOver: result.failedOver,
+			}
+			if res.Error != nil {
+				results[i].Reason = res.Error.Reason
+			}
+		}
+	}
+	return results
+}
+
+// failedResults returns the outcome of documents which couldn't be sent because of err
+func failedResults(ids []string, err error) []AckResult {
+	results := make([]AckResult, len(ids))
+	for i, id := range ids {
+		results[i] = AckResult{ID: id, Reason: err.Error()}
+	}
+	return results
+}
@@ -0,0 +1,148 @@
+package elasticwg
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestAckTracker(t *testing.T) {
+	var commits []uint64
+	tracker := newAckTracker(10, func(committed uint64) {
+		commits = append(commits, committed)
+	})
+
+	// Sequences already committed & untracked documents are ignored
+	tracker.ack([]uint64{0, 5, 10})
+	assert.Equal(t, uint64(10), tracker.getCommitted())
+
+	// The committed sequence only advances over contiguous acknowledgements
+	tracker.ack([]uint64{12, 14})
+	assert.Equal(t, uint64(10), tracker.getCommitted())
+	tracker.ack([]uint64{11})
+	assert.Equal(t, uint64(12), tracker.getCommitted())
+	tracker.ack([]uint64{13})
+	assert.Equal(t, uint64(14), tracker.getCommitted())
+	assert.Equal(t, []uint64{12, 14}, commits)
+	assert.Empty(t, tracker.acked)
+
+	var nilTracker *ackTracker
+	nilTracker.ack([]uint64{1})
+}
+
+func TestDoneSeqs(t *testing.T) {
+	items := []map[string]*elastic.BulkResponseItem{
+		{"index": {Status: http.StatusCreated}},
+		{"index": {Status: http.StatusBadRequest}},
+		{"index": {Status: http.StatusTooManyRequests}},
+		{"index": {Status: http.StatusServiceUnavailable}},
+		{"index": {Status: http.StatusConflict, Error: &elastic.ErrorDetails{Type: rejectedExecutionException}}},
+	}
+	result := &bulkResult{res: &elastic.BulkResponse{Items: items}, seqs: []uint64{1, 2, 3, 4, 5}}
+
+	// Documents rejected for good are done with, the transient failures are sent again
+	assert.Equal(t, []uint64{1, 2}, doneSeqs(result))
+
+	result.seqs = nil
+	assert.Empty(t, doneSeqs(result))
+	result.seqs = []uint64{1}
+	assert.Empty(t, doneSeqs(result))
+}
+
+func TestAckResults(t *testing.T) {
+	result := &bulkResult{
+		res: &elastic.BulkResponse{Items: []map[string]*elastic.BulkResponseItem{
+			{"index": {Id: "1", Status: http.StatusCreated}},
+			{"index": {Id: "2", Status: http.StatusBadRequest, Error: &elastic.ErrorDetails{Reason: "mapping"}}},
+		}},
+		tokens: []interface{}{1, nil},
+	}
+	assert.Equal(t, []AckResult{
+		{ID: "1", OK: true, Status: http.StatusCreated},
+		{ID: "2", Status: http.StatusBadRequest, Reason: "mapping"},
+	}, ackResults(result))
+
+	result.failedOver = true
+	assert.True(t, ackResults(result)[0].FailedOver)
+
+	// An unexpected response fails all the documents
+	result.tokens = append(result.tokens, 3)
+	for _, res := range ackResults(result) {
+		assert.False(t, res.OK)
+		assert.NotEmpty(t, res.Reason)
+	}
+
+	assert.Equal(t, []AckResult{{ID: "1", Reason: "down"}}, failedResults([]string{"1"}, errors.New("down")))
+}
+
+// ackProducer pushes count documents with their number as Ack token, & a document which can't be encoded
+type ackProducer struct {
+	count int
+}
+
+func (p *ackProducer) Produce(pe *Producer) {
+	for i := 0; i < p.count; i++ {
+		pe.Push(&Document{ID: strconv.Itoa(i), Content: map[string]int{"n": i}, Ack: i})
+	}
+	pe.Push(&Document{ID: "invalid", Content: make(chan int), Ack: -1})
+	pe.Push(&Document{ID: "untracked", Content: `{}`})
+}
+
+func TestWorkgroup_SetOnAckCallback(t *testing.T) {
+	srv := newTestBulkServer(func(id string) bool {
+		n, _ := strconv.Atoi(id)
+		return n%10 == 0
+	})
+	defer srv.Close()
+
+	var mu sync.Mutex
+	acks := map[interface{}]AckResult{}
+	onAck := func(tokens []interface{}, results []AckResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, len(tokens), len(results))
+		for i, token := range tokens {
+			if token != nil {
+				acks[token] = results[i]
+			}
+		}
+	}
+
+	wg := NewWorkgroup(srv.URL, testCfg, &ackProducer{count: 1000}, gTestLogger)
+	wg.SetOnAckCallback(onAck)
+	_, err := wg.Start(context.Background()).Wait()
+	assert.Nil(t, err)
+
+	// Each document is acknowledged with its outcome
+	mu.Lock()
+	assert.Len(t, acks, 1001)
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, strconv.Itoa(i), acks[i].ID)
+		assert.Equal(t, i%10 != 0, acks[i].OK)
+	}
+	assert.Equal(t, http.StatusBadRequest, acks[10].Status)
+	assert.False(t, acks[-1].OK)
+	assert.Equal(t, 0, acks[-1].Status)
+	mu.Unlock()
+
+	// Documents of the bulk requests given up are failed
+	failing := newFailingServer("/_bulk")
+	defer failing.Close()
+	acks = map[interface{}]AckResult{}
+	wg = NewWorkgroup(failing.URL, testCfg, &ackProducer{count: 1000}, gTestLogger)
+	wg.SetOnAckCallback(onAck)
+	_, err = wg.Start(context.Background()).Wait()
+	assert.NotNil(t, err)
+	mu.Lock()
+	assert.NotEmpty(t, acks)
+	for _, res := range acks {
+		assert.False(t, res.OK)
+		assert.NotEmpty(t, res.Reason)
+	}
+	mu.Unlock()
+}
@@ -0,0 +1,248 @@
+package elasticwg
+
+import (
+	"context"
+	"errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAdaptiveLatencyFactor = 2
+	rejectedExecutionException   = "es_rejected_execution_exception"
+)
+
+// AdaptiveConfig adaptive bulk sizing & concurrency configuration
+// When enabled, the workgroup starts with BulkSize & NumConsumers and adjusts them from the
+// cluster feedback: both grow additively while the bulk latency per document stays under
+// LatencyFactor (2 if not set) times its baseline, and are halved when it rises or when
+// Elasticsearch rejects executions (HTTP 429 or es_rejected_execution_exception).
+// Bounds default to [10, 10*BulkSize] documents per bulk and [1, 2*NumConsumers] consumers
+type AdaptiveConfig struct {
+	Enabled       bool    `yaml:"enabled"`
+	MinBulkSize   int     `yaml:"min-bulk-size"`
+	MaxBulkSize   int     `yaml:"max-bulk-size"`
+	MinConsumers  int     `yaml:"min-consumers"`
+	MaxConsumers  int     `yaml:"max-consumers"`
+	LatencyFactor float64 `yaml:"latency-factor"`
+}
+
+// withDefaults returns the configuration with its unset bounds computed from the workgroup configuration
+func (ac AdaptiveConfig) withDefaults(bulkSize, consumers int) AdaptiveConfig {
+	if ac.MinBulkSize == 0 {
+		ac.MinBulkSize = 10
+	}
+	if ac.MaxBulkSize == 0 {
+		ac.MaxBulkSize = 10 * bulkSize
+	}
+	if ac.MinConsumers == 0 {
+		ac.MinConsumers = 1
+	}
+	if ac.MaxConsumers == 0 {
+		ac.MaxConsumers = 2 * consumers
+	}
+	if ac.LatencyFactor == 0 {
+		ac.LatencyFactor = defaultAdaptiveLatencyFactor
+	}
+	return ac
+}
+
+func (ac AdaptiveConfig) validate(bulkSize, consumers int) error {
+	if !ac.Enabled {
+		return nil
+	}
+
+	ac = ac.withDefaults(bulkSize, consumers)
+	if ac.MinBulkSize < 1 || ac.MinBulkSize > ac.MaxBulkSize {
+		return errors.New("adaptive bulk size bounds must be 1 <= min <= max")
+	}
+	if ac.MinConsumers < 1 || ac.MinConsumers > ac.MaxConsumers {
+		return errors.New("adaptive consumers bounds must be 1 <= min <= max")
+	}
+	if ac.LatencyFactor <= 1 {
+		return errors.New("adaptive latency factor must be > 1")
+	}
+	return nil
+}
+
+// adaptiveController AIMD controller of the bulk size & the number of active consumers
+// Consumers with an ID greater or equal to the active count wait until it grows
+type adaptiveController struct {
+	mu         sync.Mutex
+	cfg        AdaptiveConfig
+	bulkSize   int
+	consumers  int
+	bulkStep   int
+	baseline   float64
+	generation uint64
+	successes  int
+	released   bool
+	cChange    chan struct{}
+	onChange   func(bulkSize, consumers int)
+}
+
+func newAdaptiveController(wcfg WorkgroupConfig, onChange func(bulkSize, consumers int)) *adaptiveController {
+	cfg := wcfg.Adaptive.withDefaults(wcfg.BulkSize, wcfg.NumConsumers)
+	c := &adaptiveController{
+		cfg:       cfg,
+		bulkSize:  clamp(wcfg.BulkSize, cfg.MinBulkSize, cfg.MaxBulkSize),
+		consumers: clamp(wcfg.NumConsumers, cfg.MinConsumers, cfg.MaxConsumers),
+		bulkStep:  wcfg.BulkSize / 10,
+		cChange:   make(chan struct{}),
+		onChange:  onChange,
+	}
+	if c.bulkStep < 1 {
+		c.bulkStep = 1
+	}
+	return c
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// state returns the current bulk size & number of active consumers
+func (c *adaptiveController) state() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bulkSize, c.consumers
+}
+
+// begin returns the generation a bulk request is sent in
+func (c *adaptiveController) begin() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// observe adjusts the bulk size & the active consumers from a bulk request result
+// Bulk requests sent before the last adjustment are ignored
+func (c *adaptiveController) observe(generation uint64, latency time.Duration, docs int, throttled bool) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	if generation != c.generation || docs <= 0 {
+		c.mu.Unlock()
+		return
+	}
+
+	perDoc := latency.Seconds() / float64(docs)
+	congested := throttled || (c.baseline > 0 && perDoc > c.baseline*c.cfg.LatencyFactor)
+	if !congested {
+		// The baseline follows the lowest latencies & slowly drifts up
+		if c.baseline == 0 || perDoc < c.baseline {
+			c.baseline = perDoc
+		} else {
+			c.baseline = 0.9*c.baseline + 0.1*perDoc
+		}
+	}
+
+	bulkSize, consumers := c.bulkSize, c.consumers
+	if congested {
+		bulkSize = clamp(bulkSize/2, c.cfg.MinBulkSize, c.cfg.MaxBulkSize)
+		consumers = clamp(consumers/2, c.cfg.MinConsumers, c.cfg.MaxConsumers)
+	} else {
+		// Grow once every active consumer has pushed a bulk without congestion
+		c.successes++
+		if c.successes >= c.consumers {
+			c.successes = 0
+			bulkSize = clamp(bulkSize+c.bulkStep, c.cfg.MinBulkSize, c.cfg.MaxBulkSize)
+			consumers = clamp(consumers+1, c.cfg.MinConsumers, c.cfg.MaxConsumers)
+		}
+	}
+
+	changed := bulkSize != c.bulkSize || consumers != c.consumers
+	if changed {
+		c.bulkSize, c.consumers = bulkSize, consumers
+		c.generation++
+		c.successes = 0
+		c.notify()
+	}
+	c.mu.Unlock()
+
+	if changed && c.onChange != nil {
+		c.onChange(bulkSize, consumers)
+	}
+}
+
+// notify wakes up the waiting consumers, must be called with the lock held
+func (c *adaptiveController) notify() {
+	close(c.cChange)
+	c.cChange = make(chan struct{})
+}
+
+// active returns whether the consumer id may send bulk requests
+func (c *adaptiveController) active(id int) bool {
+	if c == nil {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.released || id < c.consumers
+}
+
+// waitActive blocks until the consumer id may send bulk requests or ctx is done
+func (c *adaptiveController) waitActive(ctx context.Context, id int) error {
+	if c == nil {
+		return nil
+	}
+
+	for {
+		c.mu.Lock()
+		if c.released || id < c.consumers {
+			c.mu.Unlock()
+			return nil
+		}
+		cChange := c.cChange
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-cChange:
+		}
+	}
+}
+
+// release activates all the consumers so they drain the channel once production is finished
+func (c *adaptiveController) release() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.released = true
+	c.notify()
+}
+
+// isThrottled returns whether Elasticsearch rejected a bulk request or some of its items
+// because it is overloaded
+func isThrottled(err error, failed []*elastic.BulkResponseItem) bool {
+	if err != nil {
+		return elastic.IsStatusCode(err, http.StatusTooManyRequests)
+	}
+
+	for _, item := range failed {
+		if item.Status == http.StatusTooManyRequests ||
+			(item.Error != nil && item.Error.Type == rejectedExecutionException) {
+			return true
+		}
+	}
+	return false
+}
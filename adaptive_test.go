@@ -0,0 +1,119 @@
+package elasticwg
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+	"testing"
+	"time"
+)
+
+func newTestAdaptiveController(onChange func(int, int)) *adaptiveController {
+	cfg := testCfg
+	cfg.NumConsumers = 2
+	cfg.BulkSize = 100
+	cfg.Adaptive = AdaptiveConfig{Enabled: true, MaxBulkSize: 120, MaxConsumers: 3}
+	return newAdaptiveController(cfg, onChange)
+}
+
+func TestAdaptiveConfig_Validate(t *testing.T) {
+	assert.Nil(t, AdaptiveConfig{}.validate(500, 10))
+	assert.Nil(t, AdaptiveConfig{Enabled: true}.validate(500, 10))
+	assert.NotNil(t, AdaptiveConfig{Enabled: true, MinBulkSize: 600, MaxBulkSize: 500}.validate(500, 10))
+	assert.NotNil(t, AdaptiveConfig{Enabled: true, MinConsumers: 5, MaxConsumers: 4}.validate(500, 10))
+	assert.NotNil(t, AdaptiveConfig{Enabled: true, LatencyFactor: 0.5}.validate(500, 10))
+
+	cfg := AdaptiveConfig{}.withDefaults(500, 10)
+	assert.Equal(t, AdaptiveConfig{MinBulkSize: 10, MaxBulkSize: 5000, MinConsumers: 1, MaxConsumers: 20,
+		LatencyFactor: defaultAdaptiveLatencyFactor}, cfg)
+}
+
+func TestAdaptiveController_Increase(t *testing.T) {
+	changes := 0
+	c := newTestAdaptiveController(func(int, int) {
+		changes++
+	})
+
+	// Grows once every active consumer has pushed a bulk
+	c.observe(c.begin(), 100*time.Millisecond, 100, false)
+	bulkSize, consumers := c.state()
+	assert.Equal(t, 100, bulkSize)
+	assert.Equal(t, 2, consumers)
+
+	c.observe(c.begin(), 100*time.Millisecond, 100, false)
+	bulkSize, consumers = c.state()
+	assert.Equal(t, 110, bulkSize)
+	assert.Equal(t, 3, consumers)
+	assert.Equal(t, 1, changes)
+
+	// Up to the maximums
+	for i := 0; i < 10; i++ {
+		c.observe(c.begin(), 100*time.Millisecond, 100, false)
+	}
+	bulkSize, consumers = c.state()
+	assert.Equal(t, 120, bulkSize)
+	assert.Equal(t, 3, consumers)
+	assert.Equal(t, 2, changes)
+}
+
+func TestAdaptiveController_Decrease(t *testing.T) {
+	c := newTestAdaptiveController(nil)
+	c.observe(c.begin(), 100*time.Millisecond, 100, false)
+
+	// Bulk requests sent before a change are ignored
+	generation := c.begin()
+	c.observe(generation, 100*time.Millisecond, 100, true)
+	c.observe(generation, 100*time.Millisecond, 100, true)
+	bulkSize, consumers := c.state()
+	assert.Equal(t, 50, bulkSize)
+	assert.Equal(t, 1, consumers)
+
+	// Latency per document stays flat
+	c.observe(c.begin(), 50*time.Millisecond, 50, false)
+	bulkSize, consumers = c.state()
+	assert.Equal(t, 60, bulkSize)
+	assert.Equal(t, 2, consumers)
+
+	// Latency rising over the baseline
+	c.observe(c.begin(), time.Second, 60, false)
+	bulkSize, consumers = c.state()
+	assert.Equal(t, 30, bulkSize)
+	assert.Equal(t, 1, consumers)
+}
+
+func TestAdaptiveController_WaitActive(t *testing.T) {
+	c := newTestAdaptiveController(nil)
+	assert.True(t, c.active(1))
+	assert.False(t, c.active(2))
+
+	cDone := make(chan error)
+	go func() {
+		cDone <- c.waitActive(context.Background(), 2)
+	}()
+
+	c.observe(c.begin(), 100*time.Millisecond, 100, false)
+	c.observe(c.begin(), 100*time.Millisecond, 100, false)
+	assert.Nil(t, <-cDone)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, c.waitActive(ctx, 10))
+
+	c.release()
+	assert.True(t, c.active(10))
+
+	var nilController *adaptiveController
+	assert.True(t, nilController.active(10))
+	assert.Nil(t, nilController.waitActive(ctx, 10))
+}
+
+func TestIsThrottled(t *testing.T) {
+	assert.False(t, isThrottled(nil, nil))
+	assert.True(t, isThrottled(&elastic.Error{Status: 429}, nil))
+	assert.False(t, isThrottled(&elastic.Error{Status: 500}, nil))
+	assert.True(t, isThrottled(nil, []*elastic.BulkResponseItem{{Status: 429}}))
+	assert.True(t, isThrottled(nil, []*elastic.BulkResponseItem{
+		{Status: 503, Error: &elastic.ErrorDetails{Type: rejectedExecutionException}},
+	}))
+	assert.False(t, isThrottled(nil, []*elastic.BulkResponseItem{{Status: 400}}))
+}
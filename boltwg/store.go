@@ -0,0 +1,86 @@
+// Package boltwg provides a bbolt implementation of elasticwg.FingerprintStore
+package boltwg
+
+import (
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// Store fingerprints of the documents indexed by the previous runs, kept in a bbolt file
+// Each index has its own bucket, so a file can be shared by several workgroups
+type Store struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+// Open opens the store file at path, creating it if needed, for the documents of index
+// The file is locked until the store is closed
+func Open(path, index string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{db: db, bucket: []byte(index)}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(s.bucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get implements elasticwg.FingerprintStore
+func (s *Store) Get(id string) ([]byte, error) {
+	var fp []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// Values are only valid during the transaction
+		if v := tx.Bucket(s.bucket).Get([]byte(id)); v != nil {
+			fp = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return fp, err
+}
+
+// Put implements elasticwg.FingerprintStore
+// Concurrent calls are batched in a single transaction
+func (s *Store) Put(fingerprints map[string][]byte) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		for id, fp := range fingerprints {
+			if err := b.Put([]byte(id), fp); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Reset implements elasticwg.FingerprintStore
+func (s *Store) Reset() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(s.bucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		_, err := tx.CreateBucket(s.bucket)
+		return err
+	})
+}
+
+// Len returns the number of fingerprints in the store
+func (s *Store) Len() (int, error) {
+	var n int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(s.bucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// Close closes the store file
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,59 @@
+package boltwg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/thundersnake/elasticwg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var _ elasticwg.FingerprintStore = &Store{}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltwg")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fingerprints.db")
+
+	s, err := Open(path, "index")
+	assert.Nil(t, err)
+
+	fp, err := s.Get("1")
+	assert.Nil(t, err)
+	assert.Nil(t, fp)
+
+	assert.Nil(t, s.Put(map[string][]byte{"1": []byte("a"), "2": []byte("b")}))
+	assert.Nil(t, s.Put(map[string][]byte{"2": []byte("c")}))
+	fp, err = s.Get("2")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("c"), fp)
+
+	// Fingerprints persist across runs, separately for each index
+	assert.Nil(t, s.Close())
+	s, err = Open(path, "index")
+	assert.Nil(t, err)
+	n, err := s.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Nil(t, s.Close())
+
+	other, err := Open(path, "other")
+	assert.Nil(t, err)
+	n, err = other.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Nil(t, other.Close())
+
+	s, err = Open(path, "index")
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Nil(t, s.Reset())
+	n, err = s.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	fp, err = s.Get("1")
+	assert.Nil(t, err)
+	assert.Nil(t, fp)
+}
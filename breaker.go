@@ -0,0 +1,168 @@
+package elasticwg
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/olivere/elastic.v5"
+	"sync"
+	"time"
+)
+
+const (
+	pauseReasonBreaker     = "breaker"
+	defaultBreakerInterval = 5 * time.Second
+	defaultBreakerMaxQueue = 150
+	defaultBreakerMaxPause = 10 * time.Minute
+	// minBreakerProbeInterval avoids a health check per failed bulk when many consumers fail at once
+	minBreakerProbeInterval = time.Second
+)
+
+// breakerThreadPools the thread pools handling bulk requests, "bulk" was renamed "write" in Elasticsearch 6
+var breakerThreadPools = []string{"bulk", "write"}
+
+// BreakerConfig circuit breaker configuration, pausing the consumers while the cluster is unhealthy
+// The cluster health & the nodes bulk thread pool queues are polled every Interval (5s if not set),
+// and after a bulk request failure. Consumers are paused when the cluster status is red (or yellow
+// if PauseOnYellow is set) or when a node queue reaches MaxQueue (150 if not set), and resumed once
+// the status has recovered & all the queues are under half of MaxQueue. The run fails if it stays
+// paused for more than MaxPause (10m if not set)
+type BreakerConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Interval      time.Duration `yaml:"interval"`
+	PauseOnYellow bool          `yaml:"pause-on-yellow"`
+	MaxQueue      int           `yaml:"max-queue"`
+	MaxPause      time.Duration `yaml:"max-pause"`
+}
+
+// breaker watches the cluster health & pauses the gate of its target while it is unhealthy
+type breaker struct {
+	cfg       BreakerConfig
+	client    *elastic.Client
+	gate      *pauseGate
+	log       StructuredLogger
+	events    *runEvents
+	onTimeout func(error)
+	mu        sync.Mutex
+	open      bool
+	openedAt  time.Time
+	lastCheck time.Time
+}
+
+func newBreaker(cfg BreakerConfig, client *elastic.Client, gate *pauseGate, log StructuredLogger,
+	events *runEvents, onTimeout func(error)) *breaker {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultBreakerInterval
+	}
+	if cfg.MaxQueue <= 0 {
+		cfg.MaxQueue = defaultBreakerMaxQueue
+	}
+	if cfg.MaxPause <= 0 {
+		cfg.MaxPause = defaultBreakerMaxPause
+	}
+
+	return &breaker{
+		cfg:       cfg,
+		client:    client,
+		gate:      gate,
+		log:       log,
+		events:    events,
+		onTimeout: onTimeout,
+	}
+}
+
+// diagnose returns why ingestion should be paused, or an empty string if the cluster is healthy
+func (b *breaker) diagnose(ctx context.Context, maxQueue int) (string, error) {
+	health, err := b.client.ClusterHealth().Do(ctx)
+	if err != nil {
+		return "", err
+	}
+	if health.Status == "red" || (b.cfg.PauseOnYellow && health.Status == "yellow") {
+		return fmt.Sprintf("cluster status is %s", health.Status), nil
+	}
+
+	stats, err := b.client.NodesStats().Metric("thread_pool").Do(ctx)
+	if err != nil {
+		return "", err
+	}
+	for id, node := range stats.Nodes {
+		for _, name := range breakerThreadPools {
+			if pool, ok := node.ThreadPool[name]; ok && pool != nil && pool.Queue >= maxQueue {
+				return fmt.Sprintf("%s thread pool queue of node %s is %d", name, id, pool.Queue), nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// check polls the cluster, opens or closes the breaker & fails the run if it has been open for too long
+func (b *breaker) check(ctx context.Context, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastCheck = now
+
+	// Resume under a lower queue threshold, so the consumers don't pause again right away
+	maxQueue := b.cfg.MaxQueue
+	if b.open && maxQueue > 1 {
+		maxQueue /= 2
+	}
+
+	reason, err := b.diagnose(ctx, maxQueue)
+	if err != nil && ctx.Err() == nil {
+		b.log.Warn("Unable to check the cluster health", F("error", err))
+	}
+
+	switch {
+	case reason != "" && !b.open:
+		b.open = true
+		b.openedAt = now
+		b.gate.pause(pauseReasonBreaker)
+		b.log.Warn("Cluster unhealthy, pausing consumers", F("reason", reason))
+		b.events.publish(BreakerOpened{EventMeta: b.events.meta(), Reason: reason})
+	case reason == "" && err == nil && b.open:
+		b.open = false
+		b.gate.resume(pauseReasonBreaker)
+		b.log.Info("Cluster recovered, resuming consumers", F("paused", now.Sub(b.openedAt).String()))
+		b.events.publish(BreakerClosed{EventMeta: b.events.meta(), Paused: now.Sub(b.openedAt)})
+	}
+
+	if b.open && now.Sub(b.openedAt) > b.cfg.MaxPause {
+		b.log.Error("Cluster unhealthy for too long, aborting", F("max_pause", b.cfg.MaxPause.String()))
+		b.onTimeout(fmt.Errorf("cluster unhealthy for more than %s", b.cfg.MaxPause))
+	}
+}
+
+// watch checks the cluster every interval until ctx is done
+func (b *breaker) watch(ctx context.Context) {
+	ticker := time.NewTicker(b.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			b.check(ctx, now)
+		}
+	}
+}
+
+// probe checks the cluster after a bulk request failure, unless it has just been checked,
+// & returns whether the breaker is open
+func (b *breaker) probe(ctx context.Context) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	recent := time.Since(b.lastCheck) < minBreakerProbeInterval
+	b.mu.Unlock()
+	if !recent {
+		b.check(ctx, time.Now())
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
@@ -0,0 +1,135 @@
+package elasticwg
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClusterState the health served by newTestClusterServer
+type testClusterState struct {
+	mu     sync.Mutex
+	status string
+	queue  int
+}
+
+func (s *testClusterState) set(status string, queue int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+	s.queue = queue
+}
+
+func newTestClusterServer(state *testClusterState) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/_cluster/health"):
+			fmt.Fprintf(w, `{"status":%q}`, state.status)
+		case strings.HasPrefix(r.URL.Path, "/_nodes/stats"):
+			fmt.Fprintf(w, `{"nodes":{"n1":{"thread_pool":{"write":{"queue":%d}}}}}`, state.queue)
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+}
+
+func newTestBreaker(t *testing.T, srvURL string, onTimeout func(error)) (*breaker, *[]Event) {
+	client, _, err := newElasticClient(srvURL, ConnectionConfig{}, nil, nil)
+	assert.Nil(t, err)
+
+	var received []Event
+	bus := &eventBus{}
+	bus.subscribe(&eventSubscription{fn: func(e Event) {
+		received = append(received, e)
+	}})
+
+	b := newBreaker(BreakerConfig{Enabled: true, MaxQueue: 100, MaxPause: time.Minute}, client, newPauseGate(),
+		FromLogger(gTestLogger), &runEvents{bus: bus}, onTimeout)
+	return b, &received
+}
+
+func TestBreaker_Check(t *testing.T) {
+	state := &testClusterState{status: "green"}
+	srv := newTestClusterServer(state)
+	defer srv.Close()
+
+	b, received := newTestBreaker(t, srv.URL, nil)
+	now := time.Now()
+	b.check(context.Background(), now)
+	assert.False(t, b.gate.paused())
+
+	// Yellow only pauses if configured
+	state.set("yellow", 0)
+	b.check(context.Background(), now)
+	assert.False(t, b.gate.paused())
+
+	state.set("red", 0)
+	b.check(context.Background(), now)
+	assert.True(t, b.gate.paused())
+
+	// Resumes once the queue is under half of the threshold
+	state.set("green", 60)
+	b.check(context.Background(), now)
+	assert.True(t, b.gate.paused())
+
+	state.set("green", 10)
+	b.check(context.Background(), now.Add(time.Second))
+	assert.False(t, b.gate.paused())
+
+	state.set("green", 100)
+	b.check(context.Background(), now)
+	assert.True(t, b.gate.paused())
+
+	assert.Len(t, *received, 3)
+	assert.Equal(t, "cluster status is red", (*received)[0].(BreakerOpened).Reason)
+	assert.Equal(t, time.Second, (*received)[1].(BreakerClosed).Paused)
+	assert.Equal(t, "write thread pool queue of node n1 is 100", (*received)[2].(BreakerOpened).Reason)
+}
+
+func TestBreaker_MaxPause(t *testing.T) {
+	state := &testClusterState{status: "red"}
+	srv := newTestClusterServer(state)
+	defer srv.Close()
+
+	var timeoutErr error
+	b, _ := newTestBreaker(t, srv.URL, func(err error) {
+		timeoutErr = err
+	})
+
+	now := time.Now()
+	b.check(context.Background(), now)
+	b.check(context.Background(), now.Add(time.Minute))
+	assert.Nil(t, timeoutErr)
+
+	b.check(context.Background(), now.Add(2*time.Minute))
+	assert.NotNil(t, timeoutErr)
+}
+
+func TestBreaker_Probe(t *testing.T) {
+	state := &testClusterState{status: "green"}
+	srv := newTestClusterServer(state)
+	defer srv.Close()
+
+	var nilBreaker *breaker
+	assert.False(t, nilBreaker.probe(context.Background()))
+
+	b, _ := newTestBreaker(t, srv.URL, nil)
+	assert.False(t, b.probe(context.Background()))
+
+	// The cluster has just been checked
+	state.set("red", 0)
+	assert.False(t, b.probe(context.Background()))
+
+	b.lastCheck = time.Time{}
+	assert.True(t, b.probe(context.Background()))
+}
@@ -0,0 +1,298 @@
+package elasticwg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"sync"
+)
+
+const (
+	// CompressionGzip compresses bulk request bodies with gzip
+	CompressionGzip = "gzip"
+	// maxPooledBufferSize buffers grown bigger by a large bulk are left to the garbage collector
+	maxPooledBufferSize = 16 << 20
+)
+
+var (
+	bulkBufferPool = sync.Pool{
+		New: func() interface{} {
+			return new(bytes.Buffer)
+		},
+	}
+	gzipWriterPool = sync.Pool{
+		New: func() interface{} {
+			return gzip.NewWriter(nil)
+		},
+	}
+)
+
+func getBuffer() *bytes.Buffer {
+	buf := bulkBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBufferSize {
+		bulkBufferPool.Put(buf)
+	}
+}
+
+// bulkRequest a bulk request the consumer can send, implemented by bulkBody & elastic.BulkService
+type bulkRequest interface {
+	NumberOfActions() int
+	EstimatedSizeInBytes() int64
+	Do(ctx context.Context) (*elastic.BulkResponse, error)
+}
+
+// bulkBody a bulk request whose NDJSON body is written directly into a pooled buffer
+// The body length is exact & can be compressed before being sent
+// offsets & ids hold the start & the document ID of each action, so the body can be split
+// fingerprints holds the fingerprint of each action in incremental mode, nil otherwise
+// seqs holds the sequence number of each action when documents are acknowledged, nil otherwise
+// tokens holds the Ack token of each action when documents have one, nil otherwise
+// stamp is the member added to the sources in sync mode
+type bulkBody struct {
+	client       *elastic.Client
+	compression  string
+	buf          *bytes.Buffer
+	offsets      []int
+	ids          []string
+	fingerprints [][]byte
+	seqs         []uint64
+	tokens       []interface{}
+	stamp        []byte
+}
+
+func newBulkBody(client *elastic.Client, compression string) *bulkBody {
+	return &bulkBody{
+		client:      client,
+		compression: compression,
+		buf:         getBuffer(),
+	}
+}
+
+// add writes an index action for the document source, encoded like olivere does:
+// metadata fields in the same order, raw JSON & strings written as is, other values encoded with encoding/json
+func (b *bulkBody) add(index, docType, id string, source interface{}) error {
+	start := b.buf.Len()
+
+	b.buf.WriteString(`{"index":{`)
+	sep := false
+	for _, f := range [...]struct{ key, value string }{{"_id", id}, {"_index", index}, {"_type", docType}} {
+		if len(f.value) == 0 {
+			continue
+		}
+		if sep {
+			b.buf.WriteByte(',')
+		}
+		sep = true
+		b.buf.WriteByte('"')
+		b.buf.WriteString(f.key)
+		b.buf.WriteString(`":`)
+		writeJSONString(b.buf, f.value)
+	}
+	b.buf.WriteString("}}\n")
+
+	var data []byte
+	switch src := source.(type) {
+	case json.RawMessage:
+		data = src
+	case string:
+		data = []byte(src)
+	default:
+		encoded, err := json.Marshal(src)
+		if err != nil {
+			// Drop the partial action
+			b.buf.Truncate(start)
+			return err
+		}
+		data = encoded
+	}
+	if b.stamp == nil {
+		b.buf.Write(data)
+	} else if err := writeStamped(b.buf, data, b.stamp); err != nil {
+		b.buf.Truncate(start)
+		return err
+	}
+	b.buf.WriteByte('\n')
+
+	b.offsets = append(b.offsets, start)
+	b.ids = append(b.ids, id)
+	return nil
+}
+
+// setFingerprint records the fingerprint of the last action added, it must be called after each add
+// once a fingerprint is set, so fingerprints has one entry per action
+func (b *bulkBody) setFingerprint(fp []byte) {
+	if fp == nil && b.fingerprints == nil {
+		return
+	}
+	for len(b.fingerprints) < len(b.offsets) {
+		b.fingerprints = append(b.fingerprints, nil)
+	}
+	b.fingerprints[len(b.offsets)-1] = fp
+}
+
+// setSeq sets the sequence number of the last action added
+func (b *bulkBody) setSeq(seq uint64) {
+	if seq == 0 && b.seqs == nil {
+		return
+	}
+	for len(b.seqs) < len(b.offsets) {
+		b.seqs = append(b.seqs, 0)
+	}
+	b.seqs[len(b.offsets)-1] = seq
+}
+
+// setToken sets the Ack token of the last action added
+func (b *bulkBody) setToken(token interface{}) {
+	if token == nil && b.tokens == nil {
+		return
+	}
+	for len(b.tokens) < len(b.offsets) {
+		b.tokens = append(b.tokens, nil)
+	}
+	b.tokens[len(b.offsets)-1] = token
+}
+
+// split returns two bodies holding each half of the actions, the body needs at least 2 actions
+func (b *bulkBody) split() (*bulkBody, *bulkBody) {
+	mid := len(b.offsets) / 2
+	return b.slice(0, mid), b.slice(mid, len(b.offsets))
+}
+
+// slice returns a body holding the actions [from, to)
+func (b *bulkBody) slice(from, to int) *bulkBody {
+	end := b.buf.Len()
+	if to < len(b.offsets) {
+		end = b.offsets[to]
+	}
+
+	s := newBulkBody(b.client, b.compression)
+	s.buf.Write(b.buf.Bytes()[b.offsets[from]:end])
+	for _, offset := range b.offsets[from:to] {
+		s.offsets = append(s.offsets, offset-b.offsets[from])
+	}
+	s.ids = append(s.ids, b.ids[from:to]...)
+	if b.fingerprints != nil {
+		s.fingerprints = append(s.fingerprints, b.fingerprints[from:to]...)
+	}
+	if b.seqs != nil {
+		s.seqs = append(s.seqs, b.seqs[from:to]...)
+	}
+	if b.tokens != nil {
+		s.tokens = append(s.tokens, b.tokens[from:to]...)
+	}
+	return s
+}
+
+// source returns the source of the action i, as written to the body
+func (b *bulkBody) source(i int) json.RawMessage {
+	end := b.buf.Len()
+	if i+1 < len(b.offsets) {
+		end = b.offsets[i+1]
+	}
+	action := b.buf.Bytes()[b.offsets[i]:end]
+	line := action[bytes.IndexByte(action, '\n')+1 : len(action)-1]
+	return append(json.RawMessage(nil), line...)
+}
+
+// writeJSONString writes s as a JSON string
+func writeJSONString(buf *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < 0x20:
+			buf.WriteString(`\u00`)
+			buf.WriteByte(hex[c>>4])
+			buf.WriteByte(hex[c&0xF])
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// NumberOfActions implements bulkRequest
+func (b *bulkBody) NumberOfActions() int {
+	return len(b.offsets)
+}
+
+// EstimatedSizeInBytes implements bulkRequest, the size is the exact uncompressed body length
+func (b *bulkBody) EstimatedSizeInBytes() int64 {
+	return int64(b.buf.Len())
+}
+
+// payload returns the body to send, compressed if needed
+func (b *bulkBody) payload() (string, error) {
+	if b.compression != CompressionGzip {
+		return b.buf.String(), nil
+	}
+
+	out := getBuffer()
+	defer putBuffer(out)
+
+	w := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(w)
+	w.Reset(out)
+	if _, err := w.Write(b.buf.Bytes()); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Do implements bulkRequest
+func (b *bulkBody) Do(ctx context.Context) (*elastic.BulkResponse, error) {
+	if len(b.offsets) == 0 {
+		return nil, errors.New("elastic: No bulk actions to commit")
+	}
+
+	body, err := b.payload()
+	if err != nil {
+		return nil, err
+	}
+	if b.compression == CompressionGzip {
+		headers := http.Header{}
+		headers.Set("Content-Encoding", CompressionGzip)
+		ctx = withRequestHeaders(ctx, headers)
+	}
+
+	res, err := b.client.PerformRequestWithOptions(ctx, elastic.PerformRequestOptions{
+		Method:      "POST",
+		Path:        "/_bulk",
+		Body:        body,
+		ContentType: "application/x-ndjson",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := new(elastic.BulkResponse)
+	if err := json.Unmarshal(res.Body, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// release returns the buffer to the pool, the body must not be used anymore
+func (b *bulkBody) release() {
+	if b.buf != nil {
+		putBuffer(b.buf)
+		b.buf = nil
+	}
+}
@@ -0,0 +1,189 @@
+package elasticwg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBulkBody_Add(t *testing.T) {
+	sources := []interface{}{
+		map[string]string{"a": "b"},
+		json.RawMessage(`{"raw":true}`),
+		`{"string":true}`,
+		testBenchDocument,
+	}
+
+	body := newBulkBody(nil, "")
+	defer body.release()
+	var expected []string
+	for i, src := range sources {
+		id := strings.Repeat("x", i)
+		assert.Nil(t, body.add("idx", "doc", id, src))
+
+		lines, err := elastic.NewBulkIndexRequest().Index("idx").Type("doc").Id(id).Doc(src).Source()
+		assert.Nil(t, err)
+		expected = append(expected, lines...)
+	}
+
+	assert.Equal(t, strings.Join(expected, "\n")+"\n", body.buf.String())
+	assert.Equal(t, len(sources), body.NumberOfActions())
+	assert.Equal(t, int64(body.buf.Len()), body.EstimatedSizeInBytes())
+
+	// A source failing to encode leaves the body untouched
+	assert.NotNil(t, body.add("idx", "doc", "1", make(chan int)))
+	assert.Equal(t, strings.Join(expected, "\n")+"\n", body.buf.String())
+	assert.Equal(t, len(sources), body.NumberOfActions())
+}
+
+func TestBulkBody_Split(t *testing.T) {
+	body := newBulkBody(nil, "")
+	defer body.release()
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, body.add("idx", "doc", strconv.Itoa(i), map[string]int{"n": i}))
+		// Only the last documents have a fingerprint
+		if i >= 3 {
+			body.setFingerprint([]byte{byte(i)})
+		} else {
+			body.setFingerprint(nil)
+		}
+	}
+	assert.Equal(t, [][]byte{nil, nil, nil, {3}, {4}}, body.fingerprints)
+
+	left, right := body.split()
+	defer left.release()
+	defer right.release()
+	assert.Equal(t, 2, left.NumberOfActions())
+	assert.Equal(t, 3, right.NumberOfActions())
+	assert.Equal(t, []string{"0", "1"}, left.ids)
+	assert.Equal(t, []string{"2", "3", "4"}, right.ids)
+	assert.Equal(t, [][]byte{nil, nil}, left.fingerprints)
+	assert.Equal(t, [][]byte{nil, {3}, {4}}, right.fingerprints)
+	assert.Equal(t, body.buf.String(), left.buf.String()+right.buf.String())
+
+	// Halves can be split again
+	first, second := right.split()
+	defer first.release()
+	defer second.release()
+	assert.Equal(t, []string{"2"}, first.ids)
+	assert.Equal(t, []string{"3", "4"}, second.ids)
+	assert.Equal(t, right.buf.String(), first.buf.String()+second.buf.String())
+}
+
+func TestBulkBody_Source(t *testing.T) {
+	body := newBulkBody(nil, "")
+	defer body.release()
+	assert.Nil(t, body.add("idx", "doc", "0", map[string]int{"n": 0}))
+	assert.Nil(t, body.add("idx", "doc", "1", `{"line":"a\nb"}`))
+
+	assert.Equal(t, `{"n":0}`, string(body.source(0)))
+	assert.Equal(t, `{"line":"a\nb"}`, string(body.source(1)))
+}
+
+func TestWriteJSONString(t *testing.T) {
+	for _, s := range []string{"", "plain", `quo"te`, `back\slash`, "new\nline\ttab\x00", "<html> & é"} {
+		buf := &bytes.Buffer{}
+		writeJSONString(buf, s)
+
+		var decoded string
+		assert.Nil(t, json.Unmarshal(buf.Bytes(), &decoded), buf.String())
+		assert.Equal(t, s, decoded)
+	}
+}
+
+func TestBulkBody_DoGzip(t *testing.T) {
+	var encoding string
+	var received []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		reader := r.Body
+		if encoding == CompressionGzip {
+			zr, err := gzip.NewReader(r.Body)
+			assert.Nil(t, err)
+			reader = zr
+		}
+		received, _ = ioutil.ReadAll(reader)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"took":1,"errors":false,"items":[{"index":{"_id":"1","status":201}}]}`))
+	}))
+	defer srv.Close()
+
+	client, pool, err := newElasticClient(srv.URL, ConnectionConfig{}, nil, nil)
+	assert.Nil(t, err)
+	defer pool.Stop()
+
+	for _, compression := range []string{"", CompressionGzip} {
+		body := newBulkBody(client, compression)
+		assert.Nil(t, body.add("idx", "doc", "1", map[string]string{"a": "b"}))
+		expected := body.buf.String()
+
+		res, err := body.Do(context.Background())
+		assert.Nil(t, err)
+		assert.Len(t, res.Succeeded(), 1)
+		assert.Equal(t, compression, encoding)
+		assert.Equal(t, expected, string(received))
+		body.release()
+	}
+
+	_, err = newBulkBody(client, "").Do(context.Background())
+	assert.NotNil(t, err)
+}
+
+const benchBulkSize = 500
+
+// BenchmarkBulkBody_Olivere builds a bulk body the way olivere BulkService does
+func BenchmarkBulkBody_Olivere(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		requests := make([]elastic.BulkableRequest, 0, benchBulkSize)
+		for j := 0; j < benchBulkSize; j++ {
+			requests = append(requests, elastic.NewBulkIndexRequest().Index("idx").Type("doc").Id("1").Doc(testBenchDocument))
+		}
+
+		var body bytes.Buffer
+		for _, req := range requests {
+			lines, err := req.Source()
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, line := range lines {
+				body.WriteString(line)
+				body.WriteByte('\n')
+			}
+		}
+		_ = body.String()
+	}
+}
+
+func benchmarkBulkBody(b *testing.B, compression string) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		body := newBulkBody(nil, compression)
+		for j := 0; j < benchBulkSize; j++ {
+			if err := body.add("idx", "doc", "1", testBenchDocument); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if _, err := body.payload(); err != nil {
+			b.Fatal(err)
+		}
+		body.release()
+	}
+}
+
+func BenchmarkBulkBody(b *testing.B) {
+	benchmarkBulkBody(b, "")
+}
+
+func BenchmarkBulkBody_Gzip(b *testing.B) {
+	benchmarkBulkBody(b, CompressionGzip)
+}
@@ -0,0 +1,126 @@
+package elasticwg
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// CheckpointStore persists the checkpoint an interrupted run is resumed from
+type CheckpointStore interface {
+	// Load returns the checkpoint token saved, an empty string if there is none
+	Load() (string, error)
+	// Save records token, an empty token clears the checkpoint
+	Save(token string) error
+}
+
+// Resumer optional interface a ProducerInterface can implement to resume producing from the checkpoint
+// of an interrupted run. Resume is called before Produce with the token passed to Producer.Checkpoint
+type Resumer interface {
+	Resume(token string) error
+}
+
+// FileCheckpointStore saves the checkpoint in a file
+type FileCheckpointStore struct {
+	path string
+}
+
+// NewFileCheckpointStore returns a FileCheckpointStore saving the checkpoint in path
+func NewFileCheckpointStore(path string) *FileCheckpointStore {
+	return &FileCheckpointStore{path: path}
+}
+
+// Load implements CheckpointStore
+func (s *FileCheckpointStore) Load() (string, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(b), err
+}
+
+// Save implements CheckpointStore
+func (s *FileCheckpointStore) Save(token string) error {
+	if token == "" {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return writeFileAtomic(s.path, []byte(token))
+}
+
+// checkpoint a token & the sequence of the last document pushed before it
+type checkpoint struct {
+	seq   uint64
+	token string
+}
+
+// checkpointer saves the latest checkpoint whose documents are all acknowledged
+type checkpointer struct {
+	store     CheckpointStore
+	log       StructuredLogger
+	events    *runEvents
+	mu        sync.Mutex
+	committed uint64
+	pending   []checkpoint
+	saved     string
+}
+
+// add records a checkpoint following the document seq, saved right away if it is already acknowledged
+func (c *checkpointer) add(seq uint64, token string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq <= c.committed {
+		c.save(token)
+		return
+	}
+	c.pending = append(c.pending, checkpoint{seq: seq, token: token})
+}
+
+// commit saves the latest checkpoint whose documents up to committed are all acknowledged
+func (c *checkpointer) commit(committed uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.committed = committed
+	n := 0
+	for n < len(c.pending) && c.pending[n].seq <= committed {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	token := c.pending[n-1].token
+	c.pending = c.pending[n:]
+	c.save(token)
+}
+
+// save records token in the store
+func (c *checkpointer) save(token string) {
+	if err := c.store.Save(token); err != nil {
+		c.log.Error("Unable to save the checkpoint", F("error", err))
+		return
+	}
+	c.saved = token
+	if c.events.enabled() {
+		c.events.publish(CheckpointSaved{EventMeta: c.events.meta(), Token: token})
+	}
+}
+
+// getSaved returns the last checkpoint token saved by the run
+func (c *checkpointer) getSaved() string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.saved
+}
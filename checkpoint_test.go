@@ -0,0 +1,188 @@
+package elasticwg
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// memCheckpointStore keeps the checkpoints saved
+type memCheckpointStore struct {
+	token string
+	saved []string
+}
+
+func (s *memCheckpointStore) Load() (string, error) {
+	return s.token, nil
+}
+
+func (s *memCheckpointStore) Save(token string) error {
+	s.token = token
+	s.saved = append(s.saved, token)
+	return nil
+}
+
+// resumableProducer pushes count documents from the resumed position, with a checkpoint every n documents
+type resumableProducer struct {
+	count int
+	every int
+	from  int
+}
+
+func (p *resumableProducer) Resume(token string) error {
+	from, err := strconv.Atoi(token)
+	p.from = from
+	return err
+}
+
+func (p *resumableProducer) Produce(pe *Producer) {
+	for i := p.from; i < p.count; i++ {
+		pe.Push(&Document{ID: strconv.Itoa(i), Content: map[string]int{"n": i}})
+		if (i+1)%p.every == 0 {
+			pe.Checkpoint(strconv.Itoa(i + 1))
+		}
+	}
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elasticwg-checkpoint")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewFileCheckpointStore(filepath.Join(dir, "checkpoint"))
+	token, err := s.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "", token)
+
+	assert.Nil(t, s.Save("offset-42"))
+	token, err = s.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "offset-42", token)
+
+	assert.Nil(t, s.Save(""))
+	assert.Nil(t, s.Save(""))
+	token, err = s.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "", token)
+}
+
+func TestCheckpointer(t *testing.T) {
+	store := &memCheckpointStore{}
+	c := &checkpointer{store: store, log: FromLogger(gTestLogger)}
+
+	// Checkpoints already acknowledged are saved right away
+	c.add(0, "a")
+	c.add(10, "b")
+	c.add(20, "c")
+	c.add(30, "d")
+	assert.Equal(t, []string{"a"}, store.saved)
+
+	// Only the latest checkpoint acknowledged is saved
+	c.commit(5)
+	c.commit(25)
+	assert.Equal(t, []string{"a", "c"}, store.saved)
+	c.add(25, "e")
+	assert.Equal(t, "e", c.getSaved())
+	c.commit(30)
+	assert.Equal(t, []string{"a", "c", "e", "d"}, store.saved)
+
+	var nilCheckpointer *checkpointer
+	nilCheckpointer.add(1, "a")
+	nilCheckpointer.commit(1)
+	assert.Equal(t, "", nilCheckpointer.getSaved())
+}
+
+func TestWorkgroup_StartResume(t *testing.T) {
+	// The bulk holding the document 550 fails
+	srv := newCountingBulkServer()
+	defer srv.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_bulk" {
+			body, _ := ioutil.ReadAll(r.Body)
+			if bytes.Contains(body, []byte(`"_id":"550"`)) {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer failing.Close()
+
+	cfg := testCfg
+	cfg.NumConsumers = 1
+	cfg.BulkSize = 100
+	store := &memCheckpointStore{}
+	run := func(url string) (RunReport, error) {
+		wg := NewWorkgroup(url, cfg, &resumableProducer{count: 1000, every: 50}, gTestLogger)
+		wg.SetCheckpointStore(store)
+		return wg.Start(context.Background()).Wait()
+	}
+
+	// The checkpoint is the last one whose documents are all indexed
+	report, err := run(failing.URL)
+	assert.NotNil(t, err)
+	assert.Equal(t, "500", report.Checkpoint)
+	assert.Equal(t, "500", store.token)
+	assert.Equal(t, 500, srv.count())
+
+	// The next run resumes from it & clears it once done
+	report, err = run(srv.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, "500", report.ResumedFrom)
+	assert.Equal(t, "1000", report.Checkpoint)
+	assert.Equal(t, uint64(500), report.Indexed)
+	assert.Equal(t, 1000, srv.count())
+	assert.Equal(t, "", store.token)
+
+	// A producer with a checkpoint to resume from must be a Resumer
+	store.token = "500"
+	wg := NewWorkgroup(srv.URL, cfg, &versionedProducer{count: 10}, gTestLogger)
+	wg.SetCheckpointStore(store)
+	_, err = wg.Start(context.Background()).Wait()
+	assert.NotNil(t, err)
+}
+
+func TestWorkgroup_StartCheckpointThrottled(t *testing.T) {
+	// Elasticsearch throttles the document 550 once
+	var throttled int32
+	srv := newHookedBulkServer(testBulkHooks{item: func(item *elastic.BulkResponseItem) {
+		if item.Id == "550" && atomic.CompareAndSwapInt32(&throttled, 0, 1) {
+			item.Status = http.StatusTooManyRequests
+			item.Error = &elastic.ErrorDetails{Type: rejectedExecutionException}
+		}
+	}})
+	defer srv.Close()
+
+	cfg := testCfg
+	cfg.NumConsumers = 1
+	cfg.BulkSize = 100
+	store := &memCheckpointStore{}
+	run := func() (RunReport, error) {
+		wg := NewWorkgroup(srv.URL, cfg, &resumableProducer{count: 1000, every: 50}, gTestLogger)
+		wg.SetCheckpointStore(store)
+		return wg.Start(context.Background()).Wait()
+	}
+
+	// The checkpoint doesn't move past the document throttled, & is kept for the next run
+	report, err := run()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), report.Rejected)
+	assert.Equal(t, "550", report.Checkpoint)
+	assert.Equal(t, "550", store.token)
+
+	report, err = run()
+	assert.Nil(t, err)
+	assert.Equal(t, "550", report.ResumedFrom)
+	assert.Equal(t, uint64(450), report.Indexed)
+	assert.Equal(t, "", store.token)
+}
@@ -1,5 +1,5 @@
 #! /bin/bash
-PKG_LIST=$(go list ./... | grep -v /vendor/)
+PKG_LIST=$(go list ./... | grep -v -e /vendor/ -e /otelwg -e /slogwg)
 mkdir -p coverage
 rm -f coverage/*.cov
 for package in ${PKG_LIST}; do
@@ -1,5 +1,7 @@
 package elasticwg
 
+import "time"
+
 // IndexConfig The elasticsearch index configuration object
 type IndexConfig struct {
 	Index struct {
@@ -8,12 +10,82 @@ type IndexConfig struct {
 	} `json:"index"`
 }
 
+// ConnectionConfig Elasticsearch connection configuration object
+// Secrets can be set inline, read from a file (trailing spaces are trimmed) or
+// read from an environment variable. The first non empty source wins.
+// APIKey is the base64 encoded "id:api_key" value sent as "Authorization: ApiKey ..."
+// URLs overrides the workgroup URL with a list of nodes. Requests are distributed
+// according to Balancing (round-robin or least-loaded), failing nodes are marked
+// dead & revived by a health check every HealthcheckInterval
+// Sniff discovers the cluster nodes from URLs and balances them round-robin
+type ConnectionConfig struct {
+	URLs                []string      `yaml:"urls"`
+	Sniff               bool          `yaml:"sniff"`
+	Balancing           string        `yaml:"balancing"`
+	HealthcheckInterval time.Duration `yaml:"healthcheck-interval"`
+	Username            string        `yaml:"username"`
+	Password            string        `yaml:"password"`
+	PasswordFile        string        `yaml:"password-file"`
+	PasswordEnv         string        `yaml:"password-env"`
+	APIKey              string        `yaml:"api-key"`
+	APIKeyFile          string        `yaml:"api-key-file"`
+	APIKeyEnv           string        `yaml:"api-key-env"`
+	BearerToken         string        `yaml:"bearer-token"`
+	BearerTokenFile     string        `yaml:"bearer-token-file"`
+	BearerTokenEnv      string        `yaml:"bearer-token-env"`
+	CACertFile          string        `yaml:"ca-cert-file"`
+	ClientCertFile      string        `yaml:"client-cert-file"`
+	ClientKeyFile       string        `yaml:"client-key-file"`
+	InsecureSkipVerify  bool          `yaml:"insecure-skip-verify"`
+	ProxyURL            string        `yaml:"proxy-url"`
+}
+
 // WorkgroupConfig workgroup configuration object
+// ProgressWindow is the sliding window progress rates are measured on, 30s if not set
+// DocumentEventSampling publishes a DocumentProduced event every n documents, 1000 if not set
+// RateLimit is the initial rate limit, it can be changed while running
+// Adaptive lets the workgroup adjust BulkSize & NumConsumers from the cluster feedback
+// Breaker pauses the consumers while the cluster is unhealthy
+// MaxInFlightPerConsumer lets a consumer build its next bulk while up to n bulk requests are sent, 1 if not set
+// MaxInFlight caps the bulk requests sent at once by all the consumers, unlimited if not set
+// MemoryBudget bounds the bytes of the documents pushed & not yet sent, Push blocks while it is exhausted.
+// Unlimited if not set
+// BulkBytes flushes a bulk once its body reaches n bytes, even if it has less than BulkSize documents
+// Partitioned dispatches documents to the consumers by hash of their partition key, so the operations
+// on a key are applied in order. It is incompatible with the adaptive mode & several in-flight bulks per consumer
+// IDStrategy generates the ID of the documents pushed without one: auto (Elasticsearch generates it),
+// uuid, ulid, content-hash or template, built from IDTemplate. Elasticsearch generates it if not set
+// ForceFull forgets the fingerprints of the documents indexed by the previous runs in incremental mode,
+// so all the documents are sent
+// Sync deletes the documents not sent by the run once it succeeded
+// Targets are additional clusters each document is also written to, see TargetConfig
+// Spool writes the documents pushed to disk until they are sent, see SpoolConfig
+// Failover is a cluster or a spool the bulks are redirected to when the primary cluster is unavailable, see FailoverConfig
+// Compression compresses the bulk request bodies, only "gzip" is supported, disabled if not set
 type WorkgroupConfig struct {
-	IndexName         string `yaml:"name"`
-	DocType           string `yaml:"docType"`
-	NumConsumers      int    `yaml:"numWorkers"`
-	BulkSize          int    `yaml:"bulkSize"`
-	MappingFile       string `yaml:"mapping-file"`
-	ChannelBufferSize int    `yaml:"channel-buffer-size"`
+	IndexName              string           `yaml:"name"`
+	DocType                string           `yaml:"docType"`
+	NumConsumers           int              `yaml:"numWorkers"`
+	BulkSize               int              `yaml:"bulkSize"`
+	MappingFile            string           `yaml:"mapping-file"`
+	ChannelBufferSize      int              `yaml:"channel-buffer-size"`
+	Partitioned            bool             `yaml:"partitioned"`
+	IDStrategy             string           `yaml:"id-strategy"`
+	IDTemplate             string           `yaml:"id-template"`
+	ForceFull              bool             `yaml:"force-full"`
+	MaxInFlightPerConsumer int              `yaml:"max-in-flight-per-consumer"`
+	MaxInFlight            int              `yaml:"max-in-flight"`
+	MemoryBudget           int64            `yaml:"memory-budget"`
+	BulkBytes              int64            `yaml:"bulk-bytes"`
+	Compression            string           `yaml:"compression"`
+	ProgressWindow         time.Duration    `yaml:"progress-window"`
+	DocumentEventSampling  int              `yaml:"document-event-sampling"`
+	RateLimit              RateLimit        `yaml:"rate-limit"`
+	Adaptive               AdaptiveConfig   `yaml:"adaptive"`
+	Breaker                BreakerConfig    `yaml:"breaker"`
+	Sync                   SyncConfig       `yaml:"sync"`
+	Targets                []TargetConfig   `yaml:"targets"`
+	Failover               FailoverConfig   `yaml:"failover"`
+	Spool                  SpoolConfig      `yaml:"spool"`
+	Connection             ConnectionConfig `yaml:"connection"`
 }
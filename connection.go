@@ -0,0 +1,261 @@
+package elasticwg
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"gopkg.in/olivere/elastic.v5"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// resolveSecret returns the first non empty secret found inline, in file or in
+// the env environment variable
+func resolveSecret(value string, file string, env string) (string, error) {
+	if len(value) > 0 {
+		return value, nil
+	}
+
+	if len(file) > 0 {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("unable to read secret file '%s': %v", file, err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+
+	if len(env) > 0 {
+		return os.Getenv(env), nil
+	}
+
+	return "", nil
+}
+
+// authorizationHeader returns the Authorization header value to send on each
+// request, if API key or bearer token authentication is configured
+func (cc *ConnectionConfig) authorizationHeader() (string, error) {
+	apiKey, err := resolveSecret(cc.APIKey, cc.APIKeyFile, cc.APIKeyEnv)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := resolveSecret(cc.BearerToken, cc.BearerTokenFile, cc.BearerTokenEnv)
+	if err != nil {
+		return "", err
+	}
+
+	if len(apiKey) > 0 && len(token) > 0 {
+		return "", errors.New("API key and bearer token authentication are mutually exclusive")
+	}
+
+	if len(apiKey) > 0 {
+		return "ApiKey " + apiKey, nil
+	}
+
+	if len(token) > 0 {
+		return "Bearer " + token, nil
+	}
+
+	return "", nil
+}
+
+// tlsConfig builds the TLS configuration from the CA bundle & client certificate files
+func (cc *ConnectionConfig) tlsConfig() (*tls.Config, error) {
+	if len(cc.CACertFile) == 0 && len(cc.ClientCertFile) == 0 && !cc.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{
+		InsecureSkipVerify: cc.InsecureSkipVerify,
+	}
+
+	if len(cc.CACertFile) > 0 {
+		pem, err := ioutil.ReadFile(cc.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle '%s': %v", cc.CACertFile, err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificate found in CA bundle '%s'", cc.CACertFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if len(cc.ClientCertFile) > 0 || len(cc.ClientKeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(cc.ClientCertFile, cc.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsCfg, nil
+}
+
+// httpClient returns the HTTP client to use for Elasticsearch requests
+// If base is provided, TLS & proxy settings are ignored and only authentication
+// headers are added to its transport
+func (cc *ConnectionConfig) httpClient(base *http.Client) (*http.Client, error) {
+	authorization, err := cc.authorizationHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	var client http.Client
+	if base != nil {
+		client = *base
+	} else {
+		tlsCfg, err := cc.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		transport := newDefaultTransport()
+		transport.TLSClientConfig = tlsCfg
+
+		if len(cc.ProxyURL) > 0 {
+			proxyURL, err := url.Parse(cc.ProxyURL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy URL '%s': %v", cc.ProxyURL, err)
+			}
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+
+		client.Transport = transport
+	}
+
+	// Also adds the per-request headers, such as the bulk bodies content encoding
+	headers := http.Header{}
+	if len(authorization) > 0 {
+		headers.Set("Authorization", authorization)
+	}
+	client.Transport = &headerTransport{
+		base:    client.Transport,
+		headers: headers,
+	}
+
+	return &client, nil
+}
+
+// nodeURLs returns the node URLs to connect to, URLs taking precedence over esURL
+func (cc *ConnectionConfig) nodeURLs(esURL string) []string {
+	if len(cc.URLs) > 0 {
+		return cc.URLs
+	}
+
+	return []string{esURL}
+}
+
+// newElasticClient creates an Elasticsearch client configured with the connection config
+// The returned nodePool is nil unless many nodes are used without sniffing,
+// it must be stopped when the client is no longer used
+// If tracer is not nil, trace context is propagated into each request
+func newElasticClient(esURL string, cc ConnectionConfig, base *http.Client, tracer Tracer) (*elastic.Client, *nodePool, error) {
+	switch cc.Balancing {
+	case "", BalancingRoundRobin, BalancingLeastLoaded:
+	default:
+		return nil, nil, fmt.Errorf("unknown balancing strategy '%s'", cc.Balancing)
+	}
+
+	httpClient, err := cc.httpClient(base)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	password, err := resolveSecret(cc.Password, cc.PasswordFile, cc.PasswordEnv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	urls := cc.nodeURLs(esURL)
+	options := []elastic.ClientOptionFunc{
+		elastic.SetSniff(cc.Sniff),
+	}
+
+	if cc.HealthcheckInterval > 0 {
+		options = append(options, elastic.SetHealthcheckInterval(cc.HealthcheckInterval))
+	}
+
+	// When sniffing, olivere client discovers & balances nodes by itself. Otherwise
+	// the node pool balances requests & olivere only sees a single node
+	var pool *nodePool
+	if len(urls) > 1 && !cc.Sniff {
+		pool, err = newNodePool(urls, cc.Balancing, cc.HealthcheckInterval, httpClient.Transport)
+		if err != nil {
+			return nil, nil, err
+		}
+		httpClient.Transport = pool
+		urls = urls[:1]
+	}
+
+	if tracer != nil {
+		httpClient.Transport = &tracingTransport{
+			base:   httpClient.Transport,
+			tracer: tracer,
+		}
+	}
+
+	options = append(options, elastic.SetURL(urls...), elastic.SetHttpClient(httpClient))
+
+	if len(cc.Username) > 0 {
+		options = append(options, elastic.SetBasicAuth(cc.Username, password))
+	}
+
+	client, err := elastic.NewClient(options...)
+	if err != nil {
+		pool.Stop()
+		return nil, nil, err
+	}
+
+	return client, pool, nil
+}
+
+// requestHeadersKey the context key of the headers added to a single request
+type requestHeadersKey struct{}
+
+// withRequestHeaders returns a context adding headers to the request it is used for
+// Only clients created by the workgroup honor it
+func withRequestHeaders(ctx context.Context, headers http.Header) context.Context {
+	return context.WithValue(ctx, requestHeadersKey{}, headers)
+}
+
+// headerTransport adds static headers & the context headers to each request sent through base
+type headerTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the original request
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+len(t.headers))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	for k, v := range t.headers {
+		r.Header[k] = v
+	}
+	if headers, ok := req.Context().Value(requestHeadersKey{}).(http.Header); ok {
+		for k, v := range headers {
+			r.Header[k] = v
+		}
+	}
+
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(r)
+}
@@ -0,0 +1,23 @@
+//go:build !go1.13
+// +build !go1.13
+
+package elasticwg
+
+import "net/http"
+
+// newDefaultTransport returns a transport with the timeouts & pooling of http.DefaultTransport
+// Transport.Clone needing Go 1.13, its fields are copied one by one
+func newDefaultTransport() *http.Transport {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if dt, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport.Proxy = dt.Proxy
+		transport.DialContext = dt.DialContext
+		transport.MaxIdleConns = dt.MaxIdleConns
+		transport.MaxIdleConnsPerHost = dt.MaxIdleConnsPerHost
+		transport.IdleConnTimeout = dt.IdleConnTimeout
+		transport.TLSHandshakeTimeout = dt.TLSHandshakeTimeout
+		transport.ExpectContinueTimeout = dt.ExpectContinueTimeout
+		transport.ResponseHeaderTimeout = dt.ResponseHeaderTimeout
+	}
+	return transport
+}
@@ -0,0 +1,14 @@
+//go:build go1.13
+// +build go1.13
+
+package elasticwg
+
+import "net/http"
+
+// newDefaultTransport returns a copy of http.DefaultTransport, keeping its timeouts, pooling & HTTP/2
+func newDefaultTransport() *http.Transport {
+	if dt, ok := http.DefaultTransport.(*http.Transport); ok {
+		return dt.Clone()
+	}
+	return &http.Transport{Proxy: http.ProxyFromEnvironment}
+}
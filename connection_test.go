@@ -0,0 +1,123 @@
+package elasticwg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	f, err := ioutil.TempFile("", "elasticwg_secret")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("from-file\n")
+	f.Close()
+
+	os.Setenv("ELASTICWG_TEST_SECRET", "from-env")
+	defer os.Unsetenv("ELASTICWG_TEST_SECRET")
+
+	s, err := resolveSecret("inline", f.Name(), "ELASTICWG_TEST_SECRET")
+	assert.Nil(t, err)
+	assert.Equal(t, "inline", s)
+
+	s, err = resolveSecret("", f.Name(), "ELASTICWG_TEST_SECRET")
+	assert.Nil(t, err)
+	assert.Equal(t, "from-file", s)
+
+	s, err = resolveSecret("", "", "ELASTICWG_TEST_SECRET")
+	assert.Nil(t, err)
+	assert.Equal(t, "from-env", s)
+
+	_, err = resolveSecret("", "ci/unknown_secret_file", "")
+	assert.NotNil(t, err)
+}
+
+func TestConnectionConfig_authorizationHeader(t *testing.T) {
+	cc := ConnectionConfig{}
+	h, err := cc.authorizationHeader()
+	assert.Nil(t, err)
+	assert.Empty(t, h)
+
+	cc.APIKey = "a2V5"
+	h, err = cc.authorizationHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, "ApiKey a2V5", h)
+
+	cc.BearerToken = "token"
+	_, err = cc.authorizationHeader()
+	assert.NotNil(t, err)
+
+	cc.APIKey = ""
+	h, err = cc.authorizationHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer token", h)
+}
+
+func TestConnectionConfig_tlsConfig(t *testing.T) {
+	cc := ConnectionConfig{}
+	tlsCfg, err := cc.tlsConfig()
+	assert.Nil(t, err)
+	assert.Nil(t, tlsCfg)
+
+	cc.CACertFile = "ci/unknown_ca.pem"
+	_, err = cc.tlsConfig()
+	assert.NotNil(t, err)
+
+	cc.CACertFile = "ci/mapping_test.json"
+	_, err = cc.tlsConfig()
+	assert.NotNil(t, err)
+
+	cc.CACertFile = ""
+	cc.InsecureSkipVerify = true
+	tlsCfg, err = cc.tlsConfig()
+	assert.Nil(t, err)
+	assert.True(t, tlsCfg.InsecureSkipVerify)
+}
+
+func TestConnectionConfig_httpClientHeaders(t *testing.T) {
+	var authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	cc := ConnectionConfig{BearerToken: "token"}
+	c, err := cc.httpClient(nil)
+	assert.Nil(t, err)
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	_, err = c.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer token", authorization)
+	assert.Empty(t, req.Header.Get("Authorization"))
+
+	_, err = (&ConnectionConfig{ProxyURL: "://bad"}).httpClient(nil)
+	assert.NotNil(t, err)
+}
+
+func TestConnectionConfig_httpClientTransport(t *testing.T) {
+	// The default transport timeouts & pooling are kept
+	c, err := (&ConnectionConfig{}).httpClient(nil)
+	assert.Nil(t, err)
+	transport := c.Transport.(*headerTransport).base.(*http.Transport)
+	dt := http.DefaultTransport.(*http.Transport)
+	assert.NotNil(t, transport.DialContext)
+	assert.Equal(t, dt.TLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+	assert.Equal(t, dt.IdleConnTimeout, transport.IdleConnTimeout)
+	assert.Equal(t, dt.MaxIdleConns, transport.MaxIdleConns)
+	assert.Nil(t, transport.TLSClientConfig)
+	assert.False(t, transport == dt)
+
+	c, err = (&ConnectionConfig{InsecureSkipVerify: true, ProxyURL: "http://proxy:3128"}).httpClient(nil)
+	assert.Nil(t, err)
+	transport = c.Transport.(*headerTransport).base.(*http.Transport)
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify)
+	assert.Equal(t, dt.TLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+	req, _ := http.NewRequest("GET", "http://es:9200", nil)
+	proxy, err := transport.Proxy(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "proxy:3128", proxy.Host)
+}
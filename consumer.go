@@ -2,8 +2,12 @@ package elasticwg
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"gopkg.in/olivere/elastic.v5"
+	"net/http"
 	"sync"
+	"time"
 )
 
 // Consumer consumes produces data from the workgroup channel
@@ -13,84 +17,530 @@ type Consumer struct {
 	BulkSize       int
 	ElasticURL     string
 	onPushCallback func(int)
-	logger         Logger
+	onAckCallback  func([]interface{}, []AckResult)
+	client         *elastic.Client
+	ctx            context.Context
+	tracer         Tracer
+	metrics        Metrics
+	stats          *runStats
+	id             int
+	events         *runEvents
+	gate           *pauseGate
+	limiter        *rateLimiter
+	adaptive       *adaptiveController
+	breaker        *breaker
+	maxInFlight    int
+	inFlight       semaphore
+	budget         *memoryBudget
+	encoder        Encoder
+	compression    string
+	bulkBytes      int64
+	fingerprints   FingerprintStore
+	failover       *failover
+	acks           *ackTracker
+	stamp          []byte
+	onAbort        func(error)
+	errMu          sync.Mutex
+	err            error
+	logger         StructuredLogger
 }
 
-func (c *Consumer) pushBulk(bulkRequest *elastic.BulkService) bool {
+// getMetrics returns the consumer metrics, or a no-op implementation if not set
+func (c *Consumer) getMetrics() Metrics {
+	if c.metrics == nil {
+		return nopMetrics{}
+	}
+	return c.metrics
+}
+
+// getContext returns the consumer context, or the background context if not set
+func (c *Consumer) getContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// getTracer returns the consumer tracer, or a no-op implementation if not set
+func (c *Consumer) getTracer() Tracer {
+	if c.tracer == nil {
+		return nopTracer{}
+	}
+	return c.tracer
+}
+
+// getBulkSize returns the adaptive bulk size, or BulkSize if the workgroup isn't adaptive
+func (c *Consumer) getBulkSize() int {
+	if c.adaptive == nil {
+		return c.BulkSize
+	}
+	bulkSize, _ := c.adaptive.state()
+	return bulkSize
+}
+
+// bulkResult a bulk request accepted by Elasticsearch
+// fingerprints holds the fingerprint of each action in incremental mode
+// seqs holds the sequence number of each action when documents are acknowledged
+// tokens holds the Ack token of each action when documents have one
+type bulkResult struct {
+	res          *elastic.BulkResponse
+	actions      int
+	bytes        int64
+	latency      time.Duration
+	fingerprints [][]byte
+	seqs         []uint64
+	tokens       []interface{}
+	// failedOver tells the bulk was sent to the failover cluster, because of cause
+	failedOver bool
+	cause      error
+	// parts the results of the halves of a bulk request split, each accounted on its own
+	parts []bulkResult
+}
+
+// sentActions returns the number of actions accepted by Elasticsearch, the first halves of a bulk request
+// split can be accepted before it is given up
+func (r *bulkResult) sentActions() int {
+	if r.parts != nil {
+		n := 0
+		for i := range r.parts {
+			n += r.parts[i].sentActions()
+		}
+		return n
+	}
+	if r.res == nil {
+		return 0
+	}
+	return r.actions
+}
+
+// setErr records the first error making the consumer abort, bulk requests may fail concurrently
+func (c *Consumer) setErr(err error) {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *Consumer) pushBulk(bulkRequest bulkRequest) bool {
+	result, ok := c.sendBulk(bulkRequest)
+	c.bulkSent(result)
+	if !ok {
+		c.bulkFailed(bulkRequest, result.sentActions())
+	}
+	return ok
+}
+
+// getErr returns the error making the consumer abort, if any
+func (c *Consumer) getErr() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// ackDocuments passes the outcome of documents to the acknowledgement callback if defined
+func (c *Consumer) ackDocuments(tokens []interface{}, results func() []AckResult) {
+	if c.onAckCallback != nil && tokens != nil {
+		c.onAckCallback(tokens, results())
+	}
+}
+
+// bulkFailed fails the documents of a bulk request given up or dropped because the consumer aborts,
+// from the action sent, the previous ones being accepted by Elasticsearch
+func (c *Consumer) bulkFailed(bulkRequest bulkRequest, sent int) {
+	body, ok := bulkRequest.(*bulkBody)
+	if !ok || body.tokens == nil || sent >= len(body.ids) {
+		return
+	}
+	c.ackDocuments(body.tokens[sent:], func() []AckResult {
+		err := c.getErr()
+		if err == nil {
+			err = errors.New("bulk request given up")
+		}
+		return failedResults(body.ids[sent:], err)
+	})
+}
+
+// sendBulk sends bulkRequest to Elasticsearch, retrying up to 5 tentatives
+func (c *Consumer) sendBulk(bulkRequest bulkRequest) (bulkResult, bool) {
+	m := c.getMetrics()
 	bulkRequestActions := bulkRequest.NumberOfActions()
+	bulkRequestBytes := bulkRequest.EstimatedSizeInBytes()
+	m.AddBulks(c.Index, OutcomeProduced, 1)
 	retryCounter := 0
 performBulk:
-	_, err := bulkRequest.Do(context.Background())
+	// Wait while the run is paused & for the workgroup rate limit before each tentative
+	if err := c.gate.wait(c.getContext()); err != nil {
+		c.stats.addRejected(uint64(bulkRequestActions))
+		c.setErr(err)
+		return bulkResult{}, false
+	}
+	if err := c.limiter.wait(c.getContext(), bulkRequestActions, bulkRequestBytes); err != nil {
+		c.stats.addRejected(uint64(bulkRequestActions))
+		c.setErr(err)
+		return bulkResult{}, false
+	}
+	if err := c.inFlight.acquire(c.getContext()); err != nil {
+		c.stats.addRejected(uint64(bulkRequestActions))
+		c.setErr(err)
+		return bulkResult{}, false
+	}
+	ctx, span := c.getTracer().Start(c.getContext(), "elasticwg.Bulk",
+		Attribute{Key: "elasticwg.index", Value: c.Index},
+		Attribute{Key: "elasticwg.bulk.actions", Value: bulkRequestActions},
+		Attribute{Key: "elasticwg.bulk.bytes", Value: bulkRequestBytes},
+		Attribute{Key: "elasticwg.bulk.attempt", Value: retryCounter + 1},
+	)
+	generation := c.adaptive.begin()
+	tStart := time.Now()
+	res, err := bulkRequest.Do(ctx)
+	c.inFlight.release()
 	if err != nil {
-		c.logger.Warningf("Failed to perform a bulk query: %v", err)
+		span.RecordError(err)
+		span.End()
+		if isThrottled(err, nil) {
+			c.adaptive.observe(generation, time.Since(tStart), bulkRequestActions, true)
+		}
+		// Sending the same request again would fail the same way
+		if body, ok := bulkRequest.(*bulkBody); ok && elastic.IsStatusCode(err, http.StatusRequestEntityTooLarge) {
+			return c.splitBulk(body)
+		}
+		c.logger.Warn("Failed to perform a bulk query", F("error", err), F("attempt", retryCounter+1))
+		// Tentatives don't count while the cluster is unhealthy, the bulk is sent again once it recovered
+		if c.breaker.probe(c.getContext()) {
+			goto performBulk
+		}
 		retryCounter++
+		// Don't retry once the run is canceled
+		if ctx.Err() != nil {
+			c.stats.addRejected(uint64(bulkRequestActions))
+			c.setErr(ctx.Err())
+			return bulkResult{}, false
+		}
 		// try to push 5 times
 		if retryCounter < 5 {
+			m.AddBulks(c.Index, OutcomeRetried, 1)
+			m.AddDocuments(c.Index, OutcomeRetried, bulkRequestActions)
+			if c.events.enabled() {
+				c.events.publish(BulkRetried{EventMeta: c.events.meta(), ConsumerID: c.id,
+					Actions: bulkRequestActions, Attempt: retryCounter, Err: err})
+			}
 			goto performBulk
 		} else {
-			c.logger.Error("Unable to push bulk query after 5 tentatives, aborting consuming.")
-			return false
+			// The failover cluster takes the bulk instead of losing it
+			if c.failover != nil {
+				if result, ok := c.failOver(bulkRequest, err); ok {
+					return result, true
+				}
+			}
+			c.logger.Error("Unable to push bulk query after 5 tentatives, aborting consuming.", F("documents", bulkRequestActions))
+			m.AddBulks(c.Index, OutcomeRejected, 1)
+			m.AddDocuments(c.Index, OutcomeRejected, bulkRequestActions)
+			c.stats.addRejected(uint64(bulkRequestActions))
+			c.setErr(fmt.Errorf("unable to push bulk query after 5 tentatives: %v", err))
+			return bulkResult{}, false
+		}
+	}
+	latency := time.Since(tStart)
+
+	m.ObserveBulk(c.Index, latency, bulkRequestBytes)
+	m.AddBulks(c.Index, OutcomeIndexed, 1)
+	c.adaptive.observe(generation, latency, bulkRequestActions, isThrottled(nil, res.Failed()))
+	span.SetAttributes(Attribute{Key: "elasticwg.bulk.failed_items", Value: len(res.Failed())})
+	span.End()
+
+	result := bulkResult{res: res, actions: bulkRequestActions, bytes: bulkRequestBytes, latency: latency}
+	if body, ok := bulkRequest.(*bulkBody); ok {
+		result.fingerprints = body.fingerprints
+		result.seqs = body.seqs
+		result.tokens = body.tokens
+	}
+	return result, true
+}
+
+// splitBulk sends the halves of a bulk request Elasticsearch refused as too large, recursively
+// A single document too large is rejected, so the consumer goes on with the next documents
+func (c *Consumer) splitBulk(body *bulkBody) (bulkResult, bool) {
+	size := body.EstimatedSizeInBytes()
+	if body.NumberOfActions() == 1 {
+		reason := fmt.Sprintf("document of %d bytes exceeds the cluster http.max_content_length", size)
+		c.logger.Error("Document too large, rejecting it", F("id", body.ids[0]), F("bytes", size))
+		res := &elastic.BulkResponse{
+			Errors: true,
+			Items: []map[string]*elastic.BulkResponseItem{{
+				"index": {
+					Index:  c.Index,
+					Type:   c.DocType,
+					Id:     body.ids[0],
+					Status: http.StatusRequestEntityTooLarge,
+					Error:  &elastic.ErrorDetails{Type: "request_entity_too_large", Reason: reason},
+				},
+			}},
+		}
+		return bulkResult{res: res, actions: 1, bytes: size, fingerprints: body.fingerprints, seqs: body.seqs,
+			tokens: body.tokens}, true
+	}
+
+	c.logger.Warn("Bulk too large, splitting it", F("documents", body.NumberOfActions()), F("bytes", size))
+	left, right := body.split()
+	defer left.release()
+	defer right.release()
+
+	// The halves accepted are accounted even if the next one is given up
+	first, ok := c.sendBulk(left)
+	if !ok {
+		c.stats.addRejected(uint64(right.NumberOfActions()))
+		return first, false
+	}
+	second, ok := c.sendBulk(right)
+	return bulkResult{parts: []bulkResult{first, second}}, ok
+}
+
+// bulkSent accounts for a bulk request accepted by Elasticsearch & runs the push callback
+// Bulk requests of a consumer are accounted in the order they were built
+func (c *Consumer) bulkSent(result bulkResult) {
+	for _, part := range result.parts {
+		c.bulkSent(part)
+	}
+	// Bulk requests given up have nothing to account
+	if result.res == nil {
+		return
+	}
+
+	// Numbered documents are done with, unless they failed for a transient reason
+	c.acks.ack(doneSeqs(&result))
+	c.ackDocuments(result.tokens, func() []AckResult { return ackResults(&result) })
+
+	if result.failedOver {
+		c.bulkFailedOver(result)
+		return
+	}
+
+	m := c.getMetrics()
+	failed := result.res.Failed()
+	rejected := len(failed)
+	m.AddDocuments(c.Index, OutcomeIndexed, result.actions-rejected)
+	m.AddDocuments(c.Index, OutcomeRejected, rejected)
+	c.stats.addIndexed(uint64(result.actions - rejected))
+	c.stats.addRejected(uint64(rejected))
+
+	if c.events.enabled() {
+		for _, item := range failed {
+			e := ItemRejected{EventMeta: c.events.meta(), ConsumerID: c.id, ID: item.Id, Status: item.Status}
+			if item.Error != nil {
+				e.Reason = item.Error.Reason
+			}
+			c.events.publish(e)
+		}
+		c.events.publish(BulkSent{EventMeta: c.events.meta(), ConsumerID: c.id, Actions: result.actions,
+			Bytes: result.bytes, Latency: result.latency, Failed: rejected})
+	}
+
+	// Documents are skipped by the next runs only once indexed
+	if fps := indexedFingerprints(&result); c.fingerprints != nil && len(fps) > 0 {
+		if err := c.fingerprints.Put(fps); err != nil {
+			c.logger.Warn("Unable to record the documents fingerprints", F("error", err))
 		}
 	}
 
 	// If push callback is defined, call it
 	if c.onPushCallback != nil {
-		c.onPushCallback(bulkRequestActions)
+		c.onPushCallback(result.actions)
 	}
+}
 
-	return true
+// rejectDocument accounts for a document which can't be sent to Elasticsearch
+func (c *Consumer) rejectDocument(doc *Document, err error) {
+	c.logger.Warn("Unable to encode document", F("id", doc.ID), F("error", err))
+	c.budget.release(doc.size)
+	if doc.seq != 0 {
+		c.acks.ack([]uint64{doc.seq})
+	}
+	if doc.Ack != nil {
+		c.ackDocuments([]interface{}{doc.Ack}, func() []AckResult { return failedResults([]string{doc.ID}, err) })
+	}
+	c.getMetrics().AddDocuments(c.Index, OutcomeRejected, 1)
+	c.stats.addRejected(1)
+	if c.events.enabled() {
+		c.events.publish(ItemRejected{EventMeta: c.events.meta(), ConsumerID: c.id, ID: doc.ID, Reason: err.Error()})
+	}
+}
+
+// newBulkBody returns an empty bulk request body
+func (c *Consumer) newBulkBody() *bulkBody {
+	body := newBulkBody(c.client, c.compression)
+	body.stamp = c.stamp
+	return body
+}
+
+// flush sends body, releases bytes from the memory budget & returns the body to fill next
+func (c *Consumer) flush(pipeline *bulkPipeline, body *bulkBody, bytes int64) (*bulkBody, bool) {
+	if pipeline == nil {
+		ok := c.pushBulk(body)
+		body.release()
+		c.budget.release(bytes)
+		return c.newBulkBody(), ok
+	}
+	return c.newBulkBody(), pipeline.push(body, bytes)
+}
+
+// isBulkFull returns whether body reached the bulk size or the bulk bytes
+func (c *Consumer) isBulkFull(body *bulkBody) bool {
+	return body.NumberOfActions() >= c.getBulkSize() ||
+		(c.bulkBytes > 0 && body.EstimatedSizeInBytes() >= c.bulkBytes)
 }
 
 // Consume consume documents inside a bulk request and send it to Elasticsearch
 func (c *Consumer) Consume(cDoc chan *Document, wg *sync.WaitGroup) bool {
 	defer wg.Done()
 
-	if c.BulkSize < 100 {
-		c.logger.Errorf("Consumer bulk size is too low (%d < 100)", c.BulkSize)
+	n := 0
+	defer func() {
+		// Abort the run so the other consumers & the producer don't wait for this one
+		if c.err != nil && c.onAbort != nil {
+			c.onAbort(c.err)
+		}
+		if c.events.enabled() {
+			c.events.publish(ConsumerFinished{EventMeta: c.events.meta(), ConsumerID: c.id, Documents: n, Err: c.err})
+		}
+	}()
+
+	// Adaptive bulk sizes are bounded by the workgroup configuration
+	if c.adaptive == nil && c.BulkSize < 100 {
+		c.logger.Error("Consumer bulk size is too low", F("bulk_size", c.BulkSize), F("min_bulk_size", 100))
+		c.setErr(fmt.Errorf("consumer bulk size is too low (%d < 100)", c.BulkSize))
 		return false
 	}
 
-	client, err := elastic.NewClient(
-		elastic.SetSniff(false),
-		elastic.SetURL(c.ElasticURL),
-	)
-	if err != nil {
-		c.logger.Errorf("%v", err)
-		return false
+	// Consumers started by a workgroup share its client
+	if c.client == nil {
+		client, pool, err := newElasticClient(c.ElasticURL, ConnectionConfig{}, nil, nil)
+		if err != nil {
+			c.logger.Error("Unable to create elasticsearch client", F("error", err))
+			c.setErr(err)
+			return false
+		}
+		defer pool.Stop()
+		c.client = client
 	}
 
-	n := 0
-	bulkRequest := client.Bulk()
-	for doc := range cDoc {
+	c.getMetrics().AddActiveConsumers(c.Index, 1)
+	defer c.getMetrics().AddActiveConsumers(c.Index, -1)
+
+	// Bulk requests are sent in background when several of them can be in flight
+	var pipeline *bulkPipeline
+	if c.maxInFlight > 1 {
+		pipeline = newBulkPipeline(c)
+		defer pipeline.wait()
+	}
+
+	ctx := c.getContext()
+	body := c.newBulkBody()
+	// pendingBytes the memory held by the documents of body
+	var pendingBytes int64
+	defer func() {
+		// The documents taken before the consumer aborted are failed, after the bulk requests in flight
+		if body.NumberOfActions() > 0 {
+			if pipeline != nil {
+				pipeline.wait()
+			}
+			c.bulkFailed(body, 0)
+		}
+		body.release()
+		c.budget.release(pendingBytes)
+	}()
+	var ok bool
+	for {
+		// Flush the pending documents before going idle when the adaptive mode shrinks the consumers
+		if !c.adaptive.active(c.id) && body.NumberOfActions() > 0 {
+			body, ok = c.flush(pipeline, body, pendingBytes)
+			pendingBytes = 0
+			if !ok {
+				return false
+			}
+		}
+		if err := c.adaptive.waitActive(ctx, c.id); err != nil {
+			c.logger.Warn("Consuming canceled", F("documents", n), F("error", err))
+			c.setErr(err)
+			return false
+		}
+
+		// Stop taking documents while the run is paused
+		if err := c.gate.wait(ctx); err != nil {
+			c.logger.Warn("Consuming canceled", F("documents", n), F("error", err))
+			c.setErr(err)
+			return false
+		}
+
+		var cStarved <-chan struct{}
+		if body.NumberOfActions() > 0 {
+			cStarved = c.budget.starvedChan()
+		}
+
+		var doc *Document
+		select {
+		case <-ctx.Done():
+			c.logger.Warn("Consuming canceled", F("documents", n), F("error", ctx.Err()))
+			c.setErr(ctx.Err())
+			return false
+		case <-cStarved:
+			// The producer waits for the memory held by the pending documents
+			body, ok = c.flush(pipeline, body, pendingBytes)
+			pendingBytes = 0
+			if !ok {
+				return false
+			}
+			continue
+		case doc, ok = <-cDoc:
+		}
+		if !ok {
+			break
+		}
 		n++
 
-		req := elastic.NewBulkIndexRequest().
-			Index(c.Index).
-			Type(c.DocType).
-			Id(doc.ID).
-			Doc(doc.Content)
-		bulkRequest = bulkRequest.Add(req)
+		source, err := doc.source(c.encoder)
+		if err != nil {
+			c.rejectDocument(doc, err)
+			continue
+		}
 
-		if n%c.BulkSize == 0 {
-			if !c.pushBulk(bulkRequest) {
+		if err := body.add(c.Index, c.DocType, doc.ID, source); err != nil {
+			c.rejectDocument(doc, err)
+			continue
+		}
+		body.setFingerprint(doc.fingerprint)
+		body.setSeq(doc.seq)
+		body.setToken(doc.Ack)
+		pendingBytes += doc.size
+
+		if c.isBulkFull(body) {
+			actions := body.NumberOfActions()
+			body, ok = c.flush(pipeline, body, pendingBytes)
+			pendingBytes = 0
+			if !ok {
 				return false
 			}
 
-			if n%5000 == 0 {
-				c.logger.Infof("Pushed %d docs to elasticsearch", n)
+			if n/5000 > (n-actions)/5000 {
+				c.logger.Info("Pushed docs to elasticsearch", F("documents", n))
 			}
 		}
 	}
 
 	// Flush remaining docs
-	if bulkRequest.NumberOfActions() > 0 {
-		if !c.pushBulk(bulkRequest) {
+	if body.NumberOfActions() > 0 {
+		body, ok = c.flush(pipeline, body, pendingBytes)
+		pendingBytes = 0
+		if !ok {
 			return false
 		}
 
-		c.logger.Infof("Pushed %d docs to elasticsearch", n)
+		c.logger.Info("Pushed docs to elasticsearch", F("documents", n))
+	}
+	if pipeline != nil && !pipeline.wait() {
+		return false
 	}
 
-	c.logger.Infof("Consuming finished. Pushed %d docs to elasticsearch", n)
+	c.logger.Info("Consuming finished", F("documents", n))
 	return true
 }
@@ -1,10 +1,14 @@
 package elasticwg
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/olivere/elastic.v5"
+	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -15,7 +19,7 @@ func TestConsumer_ConsumeWrongURL(t *testing.T) {
 	w.Add(1)
 
 	consumer := Consumer{
-		logger: gTestLogger,
+		logger: FromLogger(gTestLogger),
 	}
 
 	assert.False(t, consumer.Consume(c, w))
@@ -23,7 +27,7 @@ func TestConsumer_ConsumeWrongURL(t *testing.T) {
 
 func TestConsumer_pushBulkFailure(t *testing.T) {
 	consumer := Consumer{
-		logger:     gTestLogger,
+		logger:     FromLogger(gTestLogger),
 		ElasticURL: esURL,
 	}
 
@@ -43,7 +47,7 @@ func TestConsumer_pushBulkFailure(t *testing.T) {
 
 func TestConsumer_pushBulkIndexNameMissing(t *testing.T) {
 	c := Consumer{
-		logger:     gTestLogger,
+		logger:     FromLogger(gTestLogger),
 		ElasticURL: esURL,
 		DocType:    "pushBulk",
 	}
@@ -77,7 +81,7 @@ func TestConsumer_pushBulkIndexNameMissing(t *testing.T) {
 
 func TestConsumer_pushBulkDocTypeMissing(t *testing.T) {
 	c := Consumer{
-		logger:     gTestLogger,
+		logger:     FromLogger(gTestLogger),
 		ElasticURL: esURL,
 		Index:      "Doctypemissing",
 	}
@@ -111,7 +115,7 @@ func TestConsumer_pushBulkDocTypeMissing(t *testing.T) {
 
 func TestConsumer_pushBulk(t *testing.T) {
 	c := Consumer{
-		logger:     gTestLogger,
+		logger:     FromLogger(gTestLogger),
 		ElasticURL: esURL,
 		Index:      "test3",
 		DocType:    "pushBulk",
@@ -148,7 +152,7 @@ func TestConsumer_pushBulkCallback(t *testing.T) {
 	pushedNumber := 0
 	expectedNumber := 40
 	c := Consumer{
-		logger:     gTestLogger,
+		logger:     FromLogger(gTestLogger),
 		ElasticURL: esURL,
 		Index:      "test3",
 		DocType:    "pushBulk",
@@ -189,7 +193,7 @@ func TestConsumer_pushBulkCallback(t *testing.T) {
 
 func TestConsumer_ConsumeEmpty(t *testing.T) {
 	c := Consumer{
-		logger:     gTestLogger,
+		logger:     FromLogger(gTestLogger),
 		ElasticURL: esURL,
 		Index:      "test7",
 		DocType:    "Consumer_Consume",
@@ -208,7 +212,7 @@ func TestConsumer_ConsumeEmpty(t *testing.T) {
 
 func TestConsumer_ConsumeInvalidURL(t *testing.T) {
 	c := Consumer{
-		logger:     gTestLogger,
+		logger:     FromLogger(gTestLogger),
 		ElasticURL: "http://fakeurl.fake.fake.fake.polp",
 		Index:      "test7",
 		DocType:    "Consumer_Consume",
@@ -224,7 +228,7 @@ func TestConsumer_ConsumeInvalidURL(t *testing.T) {
 
 func TestConsumer_ConsumeInvalidBulkSize(t *testing.T) {
 	c := Consumer{
-		logger:     gTestLogger,
+		logger:     FromLogger(gTestLogger),
 		ElasticURL: esURL,
 		Index:      "test7",
 		DocType:    "Consumer_Consume",
@@ -249,7 +253,7 @@ func TestConsumer_Consume(t *testing.T) {
 	expectedConsume := 50
 	consumeNumber := 0
 	c := Consumer{
-		logger:     gTestLogger,
+		logger:     FromLogger(gTestLogger),
 		ElasticURL: esURL,
 		Index:      "test7",
 		DocType:    "Consumer_Consume",
@@ -281,7 +285,7 @@ func TestConsumer_ConsumeMultiBulk(t *testing.T) {
 	expectedConsume := 250
 	consumeNumber := 0
 	c := Consumer{
-		logger:     gTestLogger,
+		logger:     FromLogger(gTestLogger),
 		ElasticURL: esURL,
 		Index:      "test8",
 		DocType:    "Consumer_ConsumeMultiBulk",
@@ -313,7 +317,7 @@ func TestConsumer_ConsumeMultiBulkLogBlock(t *testing.T) {
 	expectedConsume := 10000
 	consumeNumber := 0
 	c := Consumer{
-		logger:     gTestLogger,
+		logger:     FromLogger(gTestLogger),
 		ElasticURL: esURL,
 		Index:      "test8",
 		DocType:    "Consumer_ConsumeMultiBulk",
@@ -340,3 +344,155 @@ func TestConsumer_ConsumeMultiBulkLogBlock(t *testing.T) {
 	assert.True(t, c.Consume(ch, w))
 	assert.Equal(t, expectedConsume, consumeNumber)
 }
+
+// tooLargeStatus refuses the bulk bodies over 2000 bytes
+func tooLargeStatus(body []byte) int {
+	if len(body) > 2000 {
+		return http.StatusRequestEntityTooLarge
+	}
+	return 0
+}
+
+func TestConsumer_ConsumeTooLarge(t *testing.T) {
+	// Bodies over 2000 bytes are refused, like with http.max_content_length
+	var mu sync.Mutex
+	indexed := map[string]bool{}
+	srv := newHookedBulkServer(testBulkHooks{
+		status: tooLargeStatus,
+		item: func(item *elastic.BulkResponseItem) {
+			mu.Lock()
+			defer mu.Unlock()
+			indexed[item.Id] = true
+		},
+	})
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	assert.Nil(t, err)
+
+	pushed := 0
+	c := Consumer{
+		logger:   FromLogger(gTestLogger),
+		client:   client,
+		stats:    &runStats{},
+		Index:    "idx",
+		DocType:  "doc",
+		BulkSize: 100,
+		onPushCallback: func(i int) {
+			pushed += i
+		},
+	}
+
+	ch := make(chan *Document, 21)
+	for i := 0; i < 20; i++ {
+		ch <- &Document{ID: strconv.Itoa(i), Content: strings.Repeat("a", 300)}
+	}
+	ch <- &Document{ID: "huge", Content: strings.Repeat("a", 3000)}
+	close(ch)
+
+	w := &sync.WaitGroup{}
+	w.Add(1)
+	assert.True(t, c.Consume(ch, w))
+	assert.Equal(t, 21, pushed)
+	assert.Equal(t, uint64(20), c.stats.getIndexed())
+	assert.Equal(t, uint64(1), c.stats.getRejected())
+	assert.Len(t, indexed, 20)
+	assert.False(t, indexed["huge"])
+}
+
+func TestConsumer_ConsumeTooLargeGivenUp(t *testing.T) {
+	// Bodies over 2000 bytes are refused & the ones holding the document 15 fail
+	srv := newHookedBulkServer(testBulkHooks{status: func(body []byte) int {
+		if status := tooLargeStatus(body); status != 0 {
+			return status
+		}
+		if bytes.Contains(body, []byte(`"_id":"15"`)) {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}})
+	defer srv.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	assert.Nil(t, err)
+
+	pushed := 0
+	acks := map[interface{}]bool{}
+	c := Consumer{
+		logger:   FromLogger(gTestLogger),
+		client:   client,
+		stats:    &runStats{},
+		Index:    "idx",
+		DocType:  "doc",
+		BulkSize: 100,
+		onPushCallback: func(i int) {
+			pushed += i
+		},
+		onAckCallback: func(tokens []interface{}, results []AckResult) {
+			for i, token := range tokens {
+				acks[token] = results[i].OK
+			}
+		},
+	}
+
+	ch := make(chan *Document, 20)
+	for i := 0; i < 20; i++ {
+		ch <- &Document{ID: strconv.Itoa(i), Content: strings.Repeat("a", 300), Ack: i}
+	}
+	close(ch)
+
+	// The halves sent before the bulk is given up are accounted as indexed
+	w := &sync.WaitGroup{}
+	w.Add(1)
+	assert.False(t, c.Consume(ch, w))
+	assert.Equal(t, 15, pushed)
+	assert.Equal(t, uint64(15), c.stats.getIndexed())
+	assert.Equal(t, uint64(5), c.stats.getRejected())
+	assert.Len(t, acks, 20)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, i < 15, acks[i], "document %d", i)
+	}
+}
+
+func TestConsumer_ConsumeCanceledAck(t *testing.T) {
+	srv := newTestBulkServer(nil)
+	defer srv.Close()
+	client, err := elastic.NewSimpleClient(elastic.SetURL(srv.URL))
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var results []AckResult
+	c := Consumer{
+		logger:   FromLogger(gTestLogger),
+		client:   client,
+		ctx:      ctx,
+		stats:    &runStats{},
+		Index:    "idx",
+		DocType:  "doc",
+		BulkSize: 100,
+		onAckCallback: func(tokens []interface{}, res []AckResult) {
+			assert.Equal(t, []interface{}{0, 1, 2}, tokens)
+			results = append(results, res...)
+		},
+	}
+
+	ch := make(chan *Document)
+	w := &sync.WaitGroup{}
+	w.Add(1)
+	cDone := make(chan bool)
+	go func() {
+		cDone <- c.Consume(ch, w)
+	}()
+	for i := 0; i < 3; i++ {
+		ch <- &Document{ID: strconv.Itoa(i), Content: `{}`, Ack: i}
+	}
+	cancel()
+
+	// The documents of the bulk being built are failed
+	assert.False(t, <-cDone)
+	assert.Len(t, results, 3)
+	for _, res := range results {
+		assert.False(t, res.OK)
+		assert.Equal(t, context.Canceled.Error(), res.Reason)
+	}
+}
@@ -1,9 +1,93 @@
 package elasticwg
 
+import "encoding/json"
+
 // Document An Elasticsearch simple document
 // ID is the Elasticsearch document ID
 // Content is the document itself
+// RawContent is the document already encoded to JSON, written as is in the bulk body.
+// Content is ignored when RawContent is set
+// PartitionKey is the key documents are dispatched by in partitioned mode, ID if not set
+// Ack is an opaque token passed back to the acknowledgement callback with the outcome of the document.
+// It isn't written to the spool, documents replayed from it have none
 type Document struct {
-	ID      string
-	Content interface{}
+	ID           string
+	Content      interface{}
+	RawContent   []byte
+	PartitionKey string
+	Ack          interface{}
+	encoded      []byte
+	fingerprint  []byte
+	size         int64
+	// seq the sequence number the document is acknowledged by, 0 if not acknowledged
+	seq uint64
+}
+
+// partitionKey returns the key the document is dispatched by in partitioned mode
+func (d *Document) partitionKey() string {
+	if d.PartitionKey != "" {
+		return d.PartitionKey
+	}
+	return d.ID
+}
+
+// hashKey returns the 32-bit FNV-1a hash of key
+func hashKey(key string) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+
+	h := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= prime32
+	}
+	return h
+}
+
+// encodedContent returns the JSON content of the document
+// Contents are encoded with enc, or encoding/json if not set, & kept so consumers don't encode them again
+func (d *Document) encodedContent(enc Encoder) ([]byte, error) {
+	switch {
+	case d.RawContent != nil:
+		return d.RawContent, nil
+	case d.encoded != nil:
+		return d.encoded, nil
+	}
+
+	switch c := d.Content.(type) {
+	case json.RawMessage:
+		return c, nil
+	case string:
+		return []byte(c), nil
+	}
+	if enc == nil {
+		enc = JSONEncoder{}
+	}
+	b, err := enc.Encode(d.Content)
+	if err != nil {
+		return nil, err
+	}
+	d.encoded = b
+	return b, nil
+}
+
+// source returns the bulk source of the document
+// Pre-encoded contents are passed as raw JSON, other contents are encoded by enc if set,
+// or by the bulk request otherwise
+func (d *Document) source(enc Encoder) (interface{}, error) {
+	switch {
+	case d.RawContent != nil:
+		return json.RawMessage(d.RawContent), nil
+	case d.encoded != nil:
+		return json.RawMessage(d.encoded), nil
+	case enc != nil:
+		b, err := enc.Encode(d.Content)
+		if err != nil {
+			return nil, err
+		}
+		return json.RawMessage(b), nil
+	}
+	return d.Content, nil
 }
@@ -0,0 +1,17 @@
+package elasticwg
+
+import "encoding/json"
+
+// Encoder encodes document contents to JSON
+// Implement it to use code-generated marshalers instead of encoding/json reflection
+type Encoder interface {
+	Encode(v interface{}) ([]byte, error)
+}
+
+// JSONEncoder the Encoder based on encoding/json
+type JSONEncoder struct{}
+
+// Encode implements Encoder
+func (JSONEncoder) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
@@ -0,0 +1,120 @@
+package elasticwg
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+	"strconv"
+	"testing"
+)
+
+type benchDocument struct {
+	Name    string   `json:"name"`
+	Count   int      `json:"count"`
+	Enabled bool     `json:"enabled"`
+	Tags    []string `json:"tags"`
+}
+
+// appendJSON a hand-written marshaler, as generated by easyjson or ffjson
+func (d *benchDocument) appendJSON(b []byte) []byte {
+	b = append(b, `{"name":`...)
+	b = strconv.AppendQuote(b, d.Name)
+	b = append(b, `,"count":`...)
+	b = strconv.AppendInt(b, int64(d.Count), 10)
+	b = append(b, `,"enabled":`...)
+	b = strconv.AppendBool(b, d.Enabled)
+	b = append(b, `,"tags":[`...)
+	for i, tag := range d.Tags {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendQuote(b, tag)
+	}
+	return append(b, "]}"...)
+}
+
+type generatedEncoder struct{}
+
+func (generatedEncoder) Encode(v interface{}) ([]byte, error) {
+	d, ok := v.(*benchDocument)
+	if !ok {
+		return nil, errors.New("unsupported document")
+	}
+	return d.appendJSON(make([]byte, 0, 128)), nil
+}
+
+var testBenchDocument = &benchDocument{Name: "elasticwg", Count: 42, Enabled: true, Tags: []string{"bulk", "fast"}}
+
+func TestJSONEncoder(t *testing.T) {
+	b, err := JSONEncoder{}.Encode(testBenchDocument)
+	assert.Nil(t, err)
+
+	generated, err := generatedEncoder{}.Encode(testBenchDocument)
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), string(generated))
+}
+
+func TestDocument_Source(t *testing.T) {
+	doc := &Document{Content: testBenchDocument}
+	src, err := doc.source(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, testBenchDocument, src)
+
+	src, err = doc.source(generatedEncoder{})
+	assert.Nil(t, err)
+	assert.IsType(t, json.RawMessage{}, src)
+
+	// RawContent wins over Content
+	doc.RawContent = []byte(`{"raw":true}`)
+	src, err = doc.source(generatedEncoder{})
+	assert.Nil(t, err)
+	assert.Equal(t, json.RawMessage(`{"raw":true}`), src)
+
+	_, err = (&Document{Content: "unsupported"}).source(generatedEncoder{})
+	assert.NotNil(t, err)
+}
+
+func benchmarkBulkSource(b *testing.B, newDoc func() *Document, enc Encoder) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		src, err := newDoc().source(enc)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := elastic.NewBulkIndexRequest().Index("idx").Type("doc").Id("1").Doc(src).Source(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBulkSource_Content(b *testing.B) {
+	benchmarkBulkSource(b, func() *Document {
+		return &Document{ID: "1", Content: testBenchDocument}
+	}, nil)
+}
+
+func BenchmarkBulkSource_Encoder(b *testing.B) {
+	benchmarkBulkSource(b, func() *Document {
+		return &Document{ID: "1", Content: testBenchDocument}
+	}, generatedEncoder{})
+}
+
+func BenchmarkBulkSource_RawContent(b *testing.B) {
+	raw, _ := json.Marshal(testBenchDocument)
+	benchmarkBulkSource(b, func() *Document {
+		return &Document{ID: "1", RawContent: raw}
+	}, nil)
+}
+
+// BenchmarkBulkSource_DecodeContent the work done by a passthrough producer without RawContent
+func BenchmarkBulkSource_DecodeContent(b *testing.B) {
+	raw, _ := json.Marshal(testBenchDocument)
+	benchmarkBulkSource(b, func() *Document {
+		var content map[string]interface{}
+		if err := json.Unmarshal(raw, &content); err != nil {
+			b.Fatal(err)
+		}
+		return &Document{ID: "1", Content: content}
+	}, nil)
+}
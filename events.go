@@ -0,0 +1,291 @@
+package elasticwg
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultDocumentEventSampling = 1000
+
+// EventType identifies the kind of an Event
+type EventType string
+
+// Event types published by the workgroup
+const (
+	EventRunStarted         EventType = "run_started"
+	EventIndexCreated       EventType = "index_created"
+	EventSettingsApplied    EventType = "settings_applied"
+	EventDocumentProduced   EventType = "document_produced"
+	EventBulkSent           EventType = "bulk_sent"
+	EventBulkRetried        EventType = "bulk_retried"
+	EventBulkFailedOver     EventType = "bulk_failed_over"
+	EventItemRejected       EventType = "item_rejected"
+	EventProductionFinished EventType = "production_finished"
+	EventConsumerFinished   EventType = "consumer_finished"
+	EventBreakerOpened      EventType = "breaker_opened"
+	EventBreakerClosed      EventType = "breaker_closed"
+	EventCheckpointSaved    EventType = "checkpoint_saved"
+	EventRunFailed          EventType = "run_failed"
+	EventRunFinished        EventType = "run_finished"
+)
+
+// Event a workgroup event, subscribers use a type switch on the concrete event types
+type Event interface {
+	Type() EventType
+}
+
+// EventMeta the run an event belongs to, embedded in each event
+// Target is the name of the target the event is about when the workgroup writes to several clusters
+type EventMeta struct {
+	RunID  string
+	Index  string
+	Target string
+	Time   time.Time
+}
+
+// RunStarted published when a run starts, after the startup callback
+type RunStarted struct {
+	EventMeta
+}
+
+// IndexCreated published when the index has been created
+type IndexCreated struct {
+	EventMeta
+}
+
+// SettingsApplied published when index settings have been applied, Restored is
+// set once the settings are reset at the end of the run
+type SettingsApplied struct {
+	EventMeta
+	Settings IndexConfig
+	Restored bool
+}
+
+// DocumentProduced published every DocumentEventSampling produced documents
+// Count is the number of documents produced so far
+type DocumentProduced struct {
+	EventMeta
+	Count uint64
+}
+
+// BulkSent published when a bulk request has been accepted by Elasticsearch
+// Failed is the number of items rejected inside the bulk
+type BulkSent struct {
+	EventMeta
+	ConsumerID int
+	Actions    int
+	Bytes      int64
+	Latency    time.Duration
+	Failed     int
+}
+
+// BulkRetried published when a bulk request failed & is going to be sent again
+type BulkRetried struct {
+	EventMeta
+	ConsumerID int
+	Actions    int
+	Attempt    int
+	Err        error
+}
+
+// BulkFailedOver published when a bulk request the primary cluster kept refusing has been accepted
+// by the failover cluster Cluster. IDs are the documents indexed there & Err the primary cluster error
+type BulkFailedOver struct {
+	EventMeta
+	ConsumerID int
+	Actions    int
+	IDs        []string
+	Cluster    string
+	Err        error
+}
+
+// CheckpointSaved published when a checkpoint token has been saved, its documents being all acknowledged
+type CheckpointSaved struct {
+	EventMeta
+	Token string
+}
+
+// ItemRejected published for each document refused by Elasticsearch inside a bulk request
+type ItemRejected struct {
+	EventMeta
+	ConsumerID int
+	ID         string
+	Status     int
+	Reason     string
+}
+
+// ProductionFinished published when the producer returns
+type ProductionFinished struct {
+	EventMeta
+	Count uint64
+}
+
+// ConsumerFinished published when a consumer stops, Err is set if it aborted
+type ConsumerFinished struct {
+	EventMeta
+	ConsumerID int
+	Documents  int
+	Err        error
+}
+
+// BreakerOpened published when the consumers are paused because the cluster is unhealthy
+type BreakerOpened struct {
+	EventMeta
+	Reason string
+}
+
+// BreakerClosed published when the consumers are resumed after the cluster has recovered
+type BreakerClosed struct {
+	EventMeta
+	Paused time.Duration
+}
+
+// RunFailed published when a run fails
+type RunFailed struct {
+	EventMeta
+	Err error
+}
+
+// RunFinished published when a run succeeds
+type RunFinished struct {
+	EventMeta
+	Report RunReport
+}
+
+// Type implements Event
+func (RunStarted) Type() EventType { return EventRunStarted }
+
+// Type implements Event
+func (IndexCreated) Type() EventType { return EventIndexCreated }
+
+// Type implements Event
+func (SettingsApplied) Type() EventType { return EventSettingsApplied }
+
+// Type implements Event
+func (DocumentProduced) Type() EventType { return EventDocumentProduced }
+
+// Type implements Event
+func (BulkSent) Type() EventType { return EventBulkSent }
+
+// Type implements Event
+func (BulkRetried) Type() EventType { return EventBulkRetried }
+
+// Type implements Event
+func (CheckpointSaved) Type() EventType { return EventCheckpointSaved }
+
+// Type implements Event
+func (BulkFailedOver) Type() EventType { return EventBulkFailedOver }
+
+// Type implements Event
+func (ItemRejected) Type() EventType { return EventItemRejected }
+
+// Type implements Event
+func (ProductionFinished) Type() EventType { return EventProductionFinished }
+
+// Type implements Event
+func (ConsumerFinished) Type() EventType { return EventConsumerFinished }
+
+// Type implements Event
+func (BreakerOpened) Type() EventType { return EventBreakerOpened }
+
+// Type implements Event
+func (BreakerClosed) Type() EventType { return EventBreakerClosed }
+
+// Type implements Event
+func (RunFailed) Type() EventType { return EventRunFailed }
+
+// Type implements Event
+func (RunFinished) Type() EventType { return EventRunFinished }
+
+// eventSubscription a synchronous subscriber, or a channel one when ch is set
+type eventSubscription struct {
+	fn func(Event)
+	ch chan Event
+}
+
+// eventBus dispatches events to its subscribers
+type eventBus struct {
+	mu   sync.RWMutex
+	subs []*eventSubscription
+}
+
+func (b *eventBus) subscribe(sub *eventSubscription) func() {
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			for i, s := range b.subs {
+				if s == sub {
+					b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+					break
+				}
+			}
+			if sub.ch != nil {
+				close(sub.ch)
+			}
+		})
+	}
+}
+
+func (b *eventBus) hasSubscribers() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs) > 0
+}
+
+// publish calls synchronous subscribers in the publishing goroutine, events are
+// dropped for channel subscribers whose buffer is full
+func (b *eventBus) publish(e Event) {
+	var fns []func(Event)
+
+	b.mu.RLock()
+	for _, s := range b.subs {
+		if s.ch == nil {
+			fns = append(fns, s.fn)
+			continue
+		}
+
+		select {
+		case s.ch <- e:
+		default:
+		}
+	}
+	b.mu.RUnlock()
+
+	// Called without the lock, so subscribers may unsubscribe from their callback
+	for _, fn := range fns {
+		fn(e)
+	}
+}
+
+// runEvents publishes the events of a run on the workgroup bus
+type runEvents struct {
+	bus    *eventBus
+	runID  string
+	index  string
+	target string
+}
+
+func (e *runEvents) meta() EventMeta {
+	return EventMeta{
+		RunID:  e.runID,
+		Index:  e.index,
+		Target: e.target,
+		Time:   time.Now(),
+	}
+}
+
+func (e *runEvents) enabled() bool {
+	return e != nil && e.bus.hasSubscribers()
+}
+
+func (e *runEvents) publish(ev Event) {
+	if e != nil {
+		e.bus.publish(ev)
+	}
+}
@@ -0,0 +1,111 @@
+package elasticwg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestEventBus_Subscribe(t *testing.T) {
+	b := &eventBus{}
+	assert.False(t, b.hasSubscribers())
+
+	var received []Event
+	unsubscribe := b.subscribe(&eventSubscription{fn: func(e Event) {
+		received = append(received, e)
+	}})
+	assert.True(t, b.hasSubscribers())
+
+	b.publish(RunStarted{})
+	b.publish(BulkSent{Actions: 500})
+	unsubscribe()
+	unsubscribe()
+	b.publish(RunFinished{})
+
+	assert.Len(t, received, 2)
+	assert.Equal(t, EventRunStarted, received[0].Type())
+	assert.Equal(t, 500, received[1].(BulkSent).Actions)
+	assert.False(t, b.hasSubscribers())
+}
+
+func TestEventBus_UnsubscribeFromCallback(t *testing.T) {
+	b := &eventBus{}
+	calls := 0
+	var unsubscribe func()
+	unsubscribe = b.subscribe(&eventSubscription{fn: func(e Event) {
+		calls++
+		unsubscribe()
+	}})
+
+	b.publish(RunStarted{})
+	b.publish(RunStarted{})
+	assert.Equal(t, 1, calls)
+}
+
+func TestEventBus_Chan(t *testing.T) {
+	b := &eventBus{}
+	ch := make(chan Event, 2)
+	unsubscribe := b.subscribe(&eventSubscription{ch: ch})
+
+	// The third event is dropped as the buffer is full
+	b.publish(RunStarted{})
+	b.publish(IndexCreated{})
+	b.publish(RunFinished{})
+	unsubscribe()
+
+	var received []EventType
+	for e := range ch {
+		received = append(received, e.Type())
+	}
+	assert.Equal(t, []EventType{EventRunStarted, EventIndexCreated}, received)
+}
+
+func TestProducer_PushDocumentProducedEvents(t *testing.T) {
+	b := &eventBus{}
+	var counts []uint64
+	b.subscribe(&eventSubscription{fn: func(e Event) {
+		switch ev := e.(type) {
+		case DocumentProduced:
+			counts = append(counts, ev.Count)
+		case ProductionFinished:
+			counts = append(counts, ev.Count)
+		}
+	}})
+
+	p := Producer{
+		pi:            &testProducerInterface{},
+		events:        &runEvents{bus: b, runID: "42", index: "idx"},
+		eventSampling: 100,
+	}
+	c := make(chan *Document, 250)
+	w := &sync.WaitGroup{}
+	w.Add(1)
+	p.setChannelAndWaitGroup(c, w)
+	p.produce()
+
+	assert.Equal(t, []uint64{100, 200, 250}, counts)
+}
+
+func TestWorkgroup_SubscribeRunFailed(t *testing.T) {
+	wg := NewWorkgroup(esURL, testCfg, &testProducer{}, gTestLogger)
+	wg.SetStartupCallback(func() bool {
+		return false
+	})
+
+	ch, unsubscribe := wg.SubscribeChan(10)
+	var failures []RunFailed
+	wg.Subscribe(func(e Event) {
+		if f, ok := e.(RunFailed); ok {
+			failures = append(failures, f)
+		}
+	})
+
+	assert.False(t, wg.Run())
+	unsubscribe()
+
+	assert.Len(t, failures, 1)
+	assert.Equal(t, "test_index", failures[0].Index)
+	assert.NotEmpty(t, failures[0].RunID)
+	assert.NotNil(t, failures[0].Err)
+	assert.Equal(t, EventRunFailed, (<-ch).Type())
+}
@@ -0,0 +1,351 @@
+package elasticwg
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"gopkg.in/olivere/elastic.v5"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const replayBatchSize = 500
+
+// FailoverConfig a secondary cluster the bulks are redirected to once the primary cluster kept failing for all
+// the tentatives, instead of aborting the run. The index is created on it if needed, with the mapping
+// Redirected documents are counted as failed over, published in BulkFailedOver events & recorded by
+// the FailoverJournal if set, so a ReplayProducer can later send them to the primary cluster
+// Spool redirects the bulks to a local spool directory instead of URL, a SpoolReplayProducer sends
+// its documents to the primary cluster later. It must differ from the workgroup spool directory
+type FailoverConfig struct {
+	URL        string           `yaml:"url"`
+	Connection ConnectionConfig `yaml:"connection"`
+	Spool      SpoolConfig      `yaml:"spool"`
+}
+
+// enabled tells whether bulks are redirected somewhere when the primary cluster fails
+func (fc FailoverConfig) enabled() bool {
+	return fc.URL != "" || fc.Spool.Dir != ""
+}
+
+// validate checks the failover configuration, runSpool being the workgroup spool one
+func (fc FailoverConfig) validate(runSpool SpoolConfig) error {
+	if err := fc.Spool.validate(); err != nil {
+		return err
+	}
+	if fc.URL != "" && fc.Spool.Dir != "" {
+		return errors.New("failover needs either a cluster URL or a spool, not both")
+	}
+	if fc.Spool.Dir != "" && filepath.Clean(fc.Spool.Dir) == filepath.Clean(runSpool.Dir) {
+		return errors.New("failover spool must differ from the workgroup spool")
+	}
+	return nil
+}
+
+// FailoverRecord the documents of a bulk request redirected to the failover cluster
+type FailoverRecord struct {
+	Index   string    `json:"index"`
+	DocType string    `json:"type,omitempty"`
+	Cluster string    `json:"cluster"`
+	IDs     []string  `json:"ids"`
+	Time    time.Time `json:"time"`
+}
+
+// FailoverJournal records the documents redirected to the failover cluster
+// It must be safe for concurrent use
+type FailoverJournal interface {
+	Record(rec FailoverRecord) error
+}
+
+// JSONFailoverJournal writes the failover records to w as JSON lines, see ReadFailoverJournal
+type JSONFailoverJournal struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONFailoverJournal returns a JSONFailoverJournal writing to w
+func NewJSONFailoverJournal(w io.Writer) *JSONFailoverJournal {
+	return &JSONFailoverJournal{enc: json.NewEncoder(w)}
+}
+
+// Record implements FailoverJournal
+func (j *JSONFailoverJournal) Record(rec FailoverRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.enc.Encode(rec)
+}
+
+// ReadFailoverJournal returns the records written by a JSONFailoverJournal
+func ReadFailoverJournal(r io.Reader) ([]FailoverRecord, error) {
+	var records []FailoverRecord
+	d := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec FailoverRecord
+		if err := d.Decode(&rec); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+// failover the cluster, or the spool, the consumers redirect their bulks to when the primary cluster is unavailable
+type failover struct {
+	url     string
+	client  *elastic.Client
+	spool   *spool
+	journal FailoverJournal
+}
+
+// setupFailover creates the failover cluster client & index, or opens the failover spool
+// The index may already exist, & the cluster may be down for now: it is only needed if the primary fails
+func (w *Workgroup) setupFailover(ctx context.Context, t *target) (*failover, error) {
+	if w.cfg.Failover.Spool.Dir != "" {
+		sp, err := openSpool(w.cfg.Failover.Spool, t.log)
+		if err != nil {
+			t.log.Error("Unable to open the failover spool", F("error", err))
+			return nil, err
+		}
+		// The spool is the record of the documents redirected, the journal is for the failover cluster
+		return &failover{url: w.cfg.Failover.Spool.Dir, spool: sp}, nil
+	}
+
+	client, pool, err := newElasticClient(w.cfg.Failover.URL, w.cfg.Failover.Connection, w.httpClient, w.tracer)
+	if err != nil {
+		t.log.Error("Unable to create failover elasticsearch client", F("error", err))
+		return nil, err
+	}
+	go func() {
+		<-t.ctx.Done()
+		pool.Stop()
+	}()
+
+	if _, err := client.CreateIndex(w.cfg.IndexName).Do(ctx); err != nil {
+		t.log.Debug("Unable to create failover elasticsearch index", F("error", err))
+	}
+	if w.indexMapping != nil {
+		if _, err := client.PutMapping().Index(w.cfg.IndexName).Type(w.cfg.DocType).BodyJson(w.indexMapping).Do(ctx); err != nil {
+			t.log.Warn("Unable to put failover elasticsearch index mapping", F("error", err))
+		}
+	}
+	return &failover{url: w.cfg.Failover.URL, client: client, journal: w.failoverJournal}, nil
+}
+
+// failOver sends a bulk request the primary cluster refused to the failover cluster
+func (c *Consumer) failOver(bulkRequest bulkRequest, cause error) (bulkResult, bool) {
+	body, ok := bulkRequest.(*bulkBody)
+	if !ok {
+		return bulkResult{}, false
+	}
+	if c.failover.spool != nil {
+		return c.spoolFailOver(body, cause)
+	}
+	c.logger.Warn("Primary cluster unavailable, redirecting the bulk to the failover cluster",
+		F("documents", body.NumberOfActions()), F("error", cause))
+
+	redirected := *body
+	redirected.client = c.failover.client
+	tStart := time.Now()
+	res, err := redirected.Do(c.getContext())
+	if err != nil {
+		c.logger.Error("Unable to push bulk query to the failover cluster", F("error", err))
+		return bulkResult{}, false
+	}
+	return bulkResult{res: res, actions: body.NumberOfActions(), bytes: body.EstimatedSizeInBytes(),
+		latency: time.Since(tStart), seqs: body.seqs, tokens: body.tokens, failedOver: true, cause: cause}, true
+}
+
+// spoolFailOver writes the documents of a bulk request the primary cluster refused to the failover spool
+// The bulk succeeds as if the failover cluster had indexed them all
+func (c *Consumer) spoolFailOver(body *bulkBody, cause error) (bulkResult, bool) {
+	c.logger.Warn("Primary cluster unavailable, writing the bulk to the failover spool",
+		F("documents", body.NumberOfActions()), F("error", cause))
+
+	tStart := time.Now()
+	res := &elastic.BulkResponse{}
+	for i, id := range body.ids {
+		doc := &Document{ID: id, RawContent: body.source(i)}
+		if body.fingerprints != nil {
+			doc.fingerprint = body.fingerprints[i]
+		}
+		if err := c.failover.spool.append(doc, nil); err != nil {
+			c.logger.Error("Unable to write the bulk to the failover spool", F("error", err))
+			return bulkResult{}, false
+		}
+		res.Items = append(res.Items, map[string]*elastic.BulkResponseItem{
+			"index": {Index: c.Index, Type: c.DocType, Id: id, Status: http.StatusCreated},
+		})
+	}
+	return bulkResult{res: res, actions: body.NumberOfActions(), bytes: body.EstimatedSizeInBytes(),
+		latency: time.Since(tStart), seqs: body.seqs, tokens: body.tokens, failedOver: true, cause: cause}, true
+}
+
+// bulkFailedOver accounts for a bulk request accepted by the failover cluster & records its documents
+func (c *Consumer) bulkFailedOver(result bulkResult) {
+	m := c.getMetrics()
+	failed := result.res.Failed()
+	rejected := len(failed)
+	m.AddBulks(c.Index, OutcomeFailedOver, 1)
+	m.AddDocuments(c.Index, OutcomeFailedOver, result.actions-rejected)
+	m.AddDocuments(c.Index, OutcomeRejected, rejected)
+	c.stats.addFailedOver(uint64(result.actions - rejected))
+	c.stats.addRejected(uint64(rejected))
+
+	// Document IDs generated by Elasticsearch are only known from the response
+	var ids []string
+	for _, item := range result.res.Items {
+		for _, res := range item {
+			if res != nil && res.Status >= http.StatusOK && res.Status < http.StatusMultipleChoices {
+				ids = append(ids, res.Id)
+			}
+		}
+	}
+
+	if c.failover.journal != nil && len(ids) > 0 {
+		rec := FailoverRecord{Index: c.Index, DocType: c.DocType, Cluster: c.failover.url, IDs: ids, Time: time.Now()}
+		if err := c.failover.journal.Record(rec); err != nil {
+			c.logger.Error("Unable to record the failed over documents", F("documents", len(ids)), F("error", err))
+		}
+	}
+
+	if c.events.enabled() {
+		for _, item := range failed {
+			e := ItemRejected{EventMeta: c.events.meta(), ConsumerID: c.id, ID: item.Id, Status: item.Status}
+			if item.Error != nil {
+				e.Reason = item.Error.Reason
+			}
+			c.events.publish(e)
+		}
+		c.events.publish(BulkFailedOver{EventMeta: c.events.meta(), ConsumerID: c.id, Actions: result.actions,
+			IDs: ids, Cluster: c.failover.url, Err: result.cause})
+	}
+
+	if c.onPushCallback != nil {
+		c.onPushCallback(result.actions)
+	}
+}
+
+// ReplayProducer pushes back the documents recorded by a FailoverJournal, read from the failover cluster,
+// so a workgroup writing to the primary cluster reconciles it. Documents gone from the failover cluster
+// are ignored, Err returns the error which stopped the replay, if any
+type ReplayProducer struct {
+	client  *elastic.Client
+	records []FailoverRecord
+	err     error
+}
+
+// NewReplayProducer returns a ReplayProducer reading the documents of records with client
+func NewReplayProducer(client *elastic.Client, records []FailoverRecord) *ReplayProducer {
+	return &ReplayProducer{client: client, records: records}
+}
+
+// Produce implements ProducerInterface
+func (p *ReplayProducer) Produce(pe *Producer) {
+	for _, rec := range p.records {
+		for start := 0; start < len(rec.IDs); start += replayBatchSize {
+			end := start + replayBatchSize
+			if end > len(rec.IDs) {
+				end = len(rec.IDs)
+			}
+			if err := p.replay(pe, rec, rec.IDs[start:end]); err != nil {
+				p.err = err
+				return
+			}
+		}
+	}
+}
+
+// replay pushes the documents ids of rec
+func (p *ReplayProducer) replay(pe *Producer, rec FailoverRecord, ids []string) error {
+	mget := p.client.Mget()
+	for _, id := range ids {
+		item := elastic.NewMultiGetItem().Index(rec.Index).Id(id)
+		if rec.DocType != "" {
+			item = item.Type(rec.DocType)
+		}
+		mget = mget.Add(item)
+	}
+	res, err := mget.Do(pe.Context())
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range res.Docs {
+		if pe.Context().Err() != nil {
+			return pe.Context().Err()
+		}
+		if doc == nil || !doc.Found || doc.Source == nil {
+			continue
+		}
+		pe.Push(&Document{ID: doc.Id, RawContent: *doc.Source})
+	}
+	return nil
+}
+
+// Err returns the error which stopped the replay, if any
+func (p *ReplayProducer) Err() error {
+	return p.err
+}
+
+// SpoolReplayProducer pushes back the documents written to a failover spool, so a workgroup writing to the
+// primary cluster reconciles it. Commit drops them from the spool once that workgroup succeeded, no workgroup
+// must fail over to the spool meanwhile. Err returns the error which stopped the replay, if any
+type SpoolReplayProducer struct {
+	cfg  SpoolConfig
+	log  StructuredLogger
+	last uint64
+	err  error
+}
+
+// NewSpoolReplayProducer returns a SpoolReplayProducer reading the failover spool of cfg
+func NewSpoolReplayProducer(cfg SpoolConfig) *SpoolReplayProducer {
+	return &SpoolReplayProducer{cfg: cfg}
+}
+
+// Produce implements ProducerInterface
+func (p *SpoolReplayProducer) Produce(pe *Producer) {
+	p.log = pe.logger
+	s, err := openSpool(p.cfg, p.log)
+	if err != nil {
+		p.err = err
+		return
+	}
+	defer s.close()
+
+	p.err = s.replay(func(doc *Document) bool {
+		if pe.Context().Err() != nil {
+			return false
+		}
+		p.last = doc.seq
+		// The documents are numbered by the workgroup spool, if any
+		doc.seq = 0
+		pe.Push(doc)
+		return true
+	})
+	if p.err == nil {
+		p.err = pe.Context().Err()
+	}
+}
+
+// Commit drops the documents replayed from the spool, to be called once the workgroup succeeded
+func (p *SpoolReplayProducer) Commit() error {
+	if p.last == 0 {
+		return nil
+	}
+	s, err := openSpool(p.cfg, p.log)
+	if err != nil {
+		return err
+	}
+	s.commit(p.last)
+	return s.close()
+}
+
+// Err returns the error which stopped the replay, if any
+func (p *SpoolReplayProducer) Err() error {
+	return p.err
+}
@@ -0,0 +1,180 @@
+package elasticwg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJSONFailoverJournal(t *testing.T) {
+	buf := &bytes.Buffer{}
+	j := NewJSONFailoverJournal(buf)
+	recs := []FailoverRecord{
+		{Index: "i", DocType: "t", Cluster: "http://dr", IDs: []string{"1", "2"}, Time: time.Unix(1, 0).UTC()},
+		{Index: "i", Cluster: "http://dr", IDs: []string{"3"}, Time: time.Unix(2, 0).UTC()},
+	}
+	for _, rec := range recs {
+		assert.Nil(t, j.Record(rec))
+	}
+
+	read, err := ReadFailoverJournal(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, recs, read)
+
+	_, err = ReadFailoverJournal(bytes.NewBufferString(`{"index":`))
+	assert.NotNil(t, err)
+}
+
+func TestWorkgroup_StartFailover(t *testing.T) {
+	primary := newFailingServer("/_bulk")
+	defer primary.Close()
+	secondary := newCountingBulkServer()
+	defer secondary.Close()
+
+	journal := &bytes.Buffer{}
+	var mu sync.Mutex
+	failedOver := 0
+
+	cfg := testCfg
+	cfg.Failover = FailoverConfig{URL: secondary.URL}
+	wg := NewWorkgroup(primary.URL, cfg, &versionedProducer{count: 1000}, gTestLogger)
+	wg.SetFailoverJournal(NewJSONFailoverJournal(journal))
+	wg.Subscribe(func(e Event) {
+		if fo, ok := e.(BulkFailedOver); ok {
+			mu.Lock()
+			failedOver += len(fo.IDs)
+			mu.Unlock()
+			assert.Equal(t, secondary.URL, fo.Cluster)
+			assert.NotNil(t, fo.Err)
+		}
+	})
+	report, err := wg.Start(context.Background()).Wait()
+	assert.Nil(t, err)
+
+	// The documents refused by the primary cluster are indexed by the failover cluster & recorded
+	assert.Equal(t, uint64(0), report.Indexed)
+	assert.Equal(t, uint64(1000), report.FailedOver)
+	assert.Equal(t, 1000, secondary.count())
+	mu.Lock()
+	assert.Equal(t, 1000, failedOver)
+	mu.Unlock()
+
+	recs, err := ReadFailoverJournal(journal)
+	assert.Nil(t, err)
+	ids := map[string]bool{}
+	for _, rec := range recs {
+		assert.Equal(t, cfg.IndexName, rec.Index)
+		for _, id := range rec.IDs {
+			ids[id] = true
+		}
+	}
+	assert.Len(t, ids, 1000)
+
+	// The run fails when the failover cluster fails too
+	failing := newFailingServer("/_bulk")
+	defer failing.Close()
+	cfg.Failover = FailoverConfig{URL: failing.URL}
+	_, err = NewWorkgroup(primary.URL, cfg, &versionedProducer{count: 1000}, gTestLogger).
+		Start(context.Background()).Wait()
+	assert.NotNil(t, err)
+}
+
+func TestWorkgroup_StartFailoverSpool(t *testing.T) {
+	primary := newFailingServer("/_bulk")
+	defer primary.Close()
+	dir := newTestSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	cfg := testCfg
+	cfg.Failover = FailoverConfig{Spool: SpoolConfig{Dir: dir}}
+	wg := NewWorkgroup(primary.URL, cfg, &versionedProducer{count: 1000}, gTestLogger)
+	wg.Subscribe(func(e Event) {
+		if fo, ok := e.(BulkFailedOver); ok {
+			assert.Equal(t, dir, fo.Cluster)
+		}
+	})
+	report, err := wg.Start(context.Background()).Wait()
+	assert.Nil(t, err)
+
+	// The documents refused by the primary cluster are written to the failover spool
+	assert.Equal(t, uint64(0), report.Indexed)
+	assert.Equal(t, uint64(1000), report.FailedOver)
+
+	// They are sent to the primary cluster once it is back, & dropped from the spool once committed
+	back := newCountingBulkServer()
+	defer back.Close()
+	replay := NewSpoolReplayProducer(cfg.Failover.Spool)
+	report, err = NewWorkgroup(back.URL, testCfg, replay, gTestLogger).Start(context.Background()).Wait()
+	assert.Nil(t, err)
+	assert.Nil(t, replay.Err())
+	assert.Equal(t, uint64(1000), report.Indexed)
+	assert.Equal(t, 1000, back.count())
+	assert.Equal(t, 1, back.ids["999"])
+	assert.Nil(t, replay.Commit())
+
+	replay = NewSpoolReplayProducer(cfg.Failover.Spool)
+	report, err = NewWorkgroup(back.URL, testCfg, replay, gTestLogger).Start(context.Background()).Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), report.Indexed)
+}
+
+func TestFailoverConfig_validate(t *testing.T) {
+	assert.Nil(t, FailoverConfig{}.validate(SpoolConfig{}))
+	assert.Nil(t, FailoverConfig{URL: "http://secondary:9200"}.validate(SpoolConfig{}))
+	assert.Nil(t, FailoverConfig{Spool: SpoolConfig{Dir: "/tmp/failover"}}.validate(SpoolConfig{Dir: "/tmp/spool"}))
+	assert.NotNil(t, FailoverConfig{URL: "http://secondary:9200", Spool: SpoolConfig{Dir: "/tmp/failover"}}.
+		validate(SpoolConfig{}))
+	assert.NotNil(t, FailoverConfig{Spool: SpoolConfig{Dir: "/tmp/spool/"}}.validate(SpoolConfig{Dir: "/tmp/spool"}))
+	assert.NotNil(t, FailoverConfig{Spool: SpoolConfig{Fsync: true}}.validate(SpoolConfig{}))
+}
+
+func TestReplayProducer(t *testing.T) {
+	// The failover cluster has all the documents but 7
+	failoverSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Docs []struct {
+				Index string `json:"_index"`
+				ID    string `json:"_id"`
+			} `json:"docs"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		res := elastic.MgetResponse{}
+		for _, doc := range req.Docs {
+			source := json.RawMessage(`{"id":"` + doc.ID + `"}`)
+			res.Docs = append(res.Docs, &elastic.GetResult{Index: doc.Index, Id: doc.ID, Found: doc.ID != "7", Source: &source})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer failoverSrv.Close()
+	primary := newCountingBulkServer()
+	defer primary.Close()
+
+	var recs []FailoverRecord
+	for i := 0; i < 1200; i += 600 {
+		rec := FailoverRecord{Index: testCfg.IndexName, DocType: testCfg.DocType}
+		for id := i; id < i+600; id++ {
+			rec.IDs = append(rec.IDs, strconv.Itoa(id))
+		}
+		recs = append(recs, rec)
+	}
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(failoverSrv.URL))
+	assert.Nil(t, err)
+	replay := NewReplayProducer(client, recs)
+	report, err := NewWorkgroup(primary.URL, testCfg, replay, gTestLogger).Start(context.Background()).Wait()
+	assert.Nil(t, err)
+	assert.Nil(t, replay.Err())
+	assert.Equal(t, uint64(1199), report.Indexed)
+	assert.Equal(t, 1199, primary.count())
+}
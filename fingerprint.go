@@ -0,0 +1,69 @@
+package elasticwg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+)
+
+// FingerprintStore persists the fingerprint of the documents indexed by the previous runs
+// It must be safe for concurrent use, see the boltwg package for an implementation
+type FingerprintStore interface {
+	// Get returns the fingerprint of the document id, nil if it is unknown
+	Get(id string) ([]byte, error)
+	// Put records the fingerprints of documents accepted by Elasticsearch, by document ID
+	Put(fingerprints map[string][]byte) error
+	// Reset forgets all the fingerprints
+	Reset() error
+}
+
+// fingerprint returns the fingerprint of doc, the SHA-256 of its encoded content
+// The encoded content is kept so consumers don't encode it again
+func fingerprint(doc *Document, enc Encoder) ([]byte, error) {
+	content, err := doc.encodedContent(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(content)
+	return sum[:], nil
+}
+
+// unchanged returns whether doc was indexed with the same content by a previous run
+// The fingerprint of a changed document is kept to be recorded once it is indexed
+func unchanged(store FingerprintStore, doc *Document, enc Encoder) (bool, error) {
+	fp, err := fingerprint(doc, enc)
+	if err != nil {
+		return false, err
+	}
+	prev, err := store.Get(doc.ID)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(prev, fp) {
+		return true, nil
+	}
+	doc.fingerprint = fp
+	return false, nil
+}
+
+// indexedFingerprints returns the fingerprints of the documents of a bulk request accepted by Elasticsearch
+// Items are in the order of the actions, an unexpected response isn't trusted
+func indexedFingerprints(res *bulkResult) map[string][]byte {
+	if res.fingerprints == nil || len(res.res.Items) != len(res.fingerprints) {
+		return nil
+	}
+
+	indexed := make(map[string][]byte, len(res.fingerprints))
+	for i, item := range res.res.Items {
+		if res.fingerprints[i] == nil {
+			continue
+		}
+		for _, result := range item {
+			if result != nil && result.Status >= http.StatusOK && result.Status < http.StatusMultipleChoices {
+				indexed[result.Id] = res.fingerprints[i]
+			}
+		}
+	}
+	return indexed
+}
@@ -0,0 +1,167 @@
+package elasticwg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mapStore an in-memory FingerprintStore
+type mapStore struct {
+	mu  sync.Mutex
+	fps map[string][]byte
+	err error
+}
+
+func newMapStore() *mapStore {
+	return &mapStore{fps: map[string][]byte{}}
+}
+
+func (s *mapStore) Get(id string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fps[id], s.err
+}
+
+func (s *mapStore) Put(fingerprints map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, fp := range fingerprints {
+		s.fps[id] = fp
+	}
+	return s.err
+}
+
+func (s *mapStore) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fps = map[string][]byte{}
+	return s.err
+}
+
+func (s *mapStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.fps)
+}
+
+func TestFingerprint(t *testing.T) {
+	doc := &Document{Content: map[string]string{"a": "b"}}
+	fp, err := fingerprint(doc, nil)
+	assert.Nil(t, err)
+	assert.Len(t, fp, 32)
+	// The encoded content is kept for the consumer
+	assert.Equal(t, `{"a":"b"}`, string(doc.encoded))
+
+	for _, same := range []*Document{
+		{Content: json.RawMessage(`{"a":"b"}`)},
+		{Content: `{"a":"b"}`},
+		{RawContent: []byte(`{"a":"b"}`)},
+	} {
+		other, err := fingerprint(same, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, fp, other)
+	}
+
+	_, err = fingerprint(&Document{Content: make(chan int)}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestIndexedFingerprints(t *testing.T) {
+	result := &bulkResult{
+		res: &elastic.BulkResponse{Items: []map[string]*elastic.BulkResponseItem{
+			{"index": {Id: "1", Status: http.StatusCreated}},
+			{"index": {Id: "2", Status: http.StatusBadRequest}},
+			{"index": {Id: "3", Status: http.StatusOK}},
+			{"index": {Id: "4", Status: http.StatusOK}},
+		}},
+		fingerprints: [][]byte{[]byte("a"), []byte("b"), []byte("c"), nil},
+	}
+	assert.Equal(t, map[string][]byte{"1": []byte("a"), "3": []byte("c")}, indexedFingerprints(result))
+
+	// Responses not matching the actions are ignored
+	result.fingerprints = result.fingerprints[:2]
+	assert.Nil(t, indexedFingerprints(result))
+}
+
+// versionedProducer pushes count documents, the first changed ones with a new content
+type versionedProducer struct {
+	count   int
+	changed int
+}
+
+func (p *versionedProducer) Produce(pe *Producer) {
+	for i := 0; i < p.count; i++ {
+		content := map[string]interface{}{"n": i}
+		if i < p.changed {
+			content["changed"] = true
+		}
+		pe.Push(&Document{ID: strconv.Itoa(i), Content: content})
+	}
+}
+
+func TestWorkgroup_StartIncremental(t *testing.T) {
+	// Document 0 is rejected once
+	var mu sync.Mutex
+	rejected := false
+	srv := newTestBulkServer(func(id string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if id == "0" && !rejected {
+			rejected = true
+			return true
+		}
+		return false
+	})
+	defer srv.Close()
+
+	store := newMapStore()
+	run := func(p ProducerInterface, cfg WorkgroupConfig) RunReport {
+		wg := NewWorkgroup(srv.URL, cfg, p, gTestLogger)
+		wg.SetFingerprintStore(store)
+		report, err := wg.Start(context.Background()).Wait()
+		assert.Nil(t, err)
+		return report
+	}
+
+	// Only the documents indexed are recorded
+	report := run(&versionedProducer{count: 1000}, testCfg)
+	assert.Equal(t, uint64(999), report.Indexed)
+	assert.Equal(t, uint64(1), report.Rejected)
+	assert.Equal(t, uint64(0), report.Skipped)
+	assert.Equal(t, 999, store.len())
+
+	// Unchanged documents are skipped, the rejected one is sent again
+	report = run(&versionedProducer{count: 1000, changed: 10}, testCfg)
+	assert.Equal(t, uint64(10), report.Indexed)
+	assert.Equal(t, uint64(10), report.Produced)
+	assert.Equal(t, uint64(990), report.Skipped)
+	assert.Equal(t, 1000, store.len())
+
+	cfg := testCfg
+	cfg.ForceFull = true
+	report = run(&versionedProducer{count: 1000, changed: 10}, cfg)
+	assert.Equal(t, uint64(1000), report.Indexed)
+	assert.Equal(t, uint64(0), report.Skipped)
+
+	// The run fails if the store can't be reset, without reporting its progress
+	store.err = errors.New("store failure")
+	var progress int32
+	wg := NewWorkgroup(srv.URL, cfg, &versionedProducer{count: 10}, gTestLogger)
+	wg.SetFingerprintStore(store)
+	wg.SetProgressCallback(time.Millisecond, func(ProgressSnapshot) {
+		atomic.AddInt32(&progress, 1)
+	})
+	_, err := wg.Start(context.Background()).Wait()
+	assert.NotNil(t, err)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&progress))
+}
@@ -0,0 +1,272 @@
+package elasticwg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IDStrategy generates the ID of the documents pushed without one
+// An empty ID lets Elasticsearch generate it
+type IDStrategy interface {
+	GenerateID(doc *Document) (string, error)
+}
+
+// AutoIDStrategy lets Elasticsearch generate the IDs, the default behavior
+type AutoIDStrategy struct{}
+
+// GenerateID implements IDStrategy
+func (AutoIDStrategy) GenerateID(doc *Document) (string, error) {
+	return "", nil
+}
+
+// UUIDStrategy generates random UUIDv4 IDs
+type UUIDStrategy struct{}
+
+// GenerateID implements IDStrategy
+func (UUIDStrategy) GenerateID(doc *Document) (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+
+	var b [36]byte
+	hex.Encode(b[0:8], u[0:4])
+	b[8] = '-'
+	hex.Encode(b[9:13], u[4:6])
+	b[13] = '-'
+	hex.Encode(b[14:18], u[6:8])
+	b[18] = '-'
+	hex.Encode(b[19:23], u[8:10])
+	b[23] = '-'
+	hex.Encode(b[24:], u[10:])
+	return string(b[:]), nil
+}
+
+// crockfordAlphabet the base32 alphabet of ULIDs
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULIDStrategy generates ULID IDs, sorted by generation time
+// IDs generated within the same millisecond are incremented, so they stay sorted. Its zero value is ready to use
+type ULIDStrategy struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	last    uint64
+	entropy [10]byte
+}
+
+// NewULIDStrategy returns a ULIDStrategy
+func NewULIDStrategy() *ULIDStrategy {
+	return &ULIDStrategy{now: time.Now}
+}
+
+// GenerateID implements IDStrategy
+func (s *ULIDStrategy) GenerateID(doc *Document) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now
+	if now == nil {
+		now = time.Now
+	}
+	ms := uint64(now().UnixNano() / int64(time.Millisecond))
+	if ms > s.last {
+		if _, err := rand.Read(s.entropy[:]); err != nil {
+			return "", err
+		}
+		s.last = ms
+	} else if !incrementEntropy(&s.entropy) {
+		return "", fmt.Errorf("ULID entropy exhausted for millisecond %d", s.last)
+	}
+
+	var u [16]byte
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], s.last)
+	copy(u[:6], ts[2:])
+	copy(u[6:], s.entropy[:])
+	return encodeULID(u), nil
+}
+
+// incrementEntropy increments the entropy as a big-endian integer, & returns false on overflow
+func incrementEntropy(entropy *[10]byte) bool {
+	for i := len(entropy) - 1; i >= 0; i-- {
+		entropy[i]++
+		if entropy[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID encodes the 128 bits of u as 26 Crockford base32 characters
+func encodeULID(u [16]byte) string {
+	var b [26]byte
+	// 130 bits are encoded, the 2 leading ones are always zero
+	var acc uint32
+	bits := 2
+	pos := 0
+	for _, v := range u {
+		acc = acc<<8 | uint32(v)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			b[pos] = crockfordAlphabet[(acc>>uint(bits))&0x1f]
+			pos++
+		}
+	}
+	return string(b[:])
+}
+
+// ContentHashStrategy generates the hex SHA-256 of the canonical JSON content, so a document pushed
+// again with the same content overwrites itself. Object keys are sorted & insignificant spaces removed
+type ContentHashStrategy struct{}
+
+// GenerateID implements IDStrategy
+func (ContentHashStrategy) GenerateID(doc *Document) (string, error) {
+	content, err := decodeContent(doc)
+	if err != nil {
+		return "", err
+	}
+	canonical, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// decodeContent returns the document content decoded from JSON, numbers are kept as written
+func decodeContent(doc *Document) (interface{}, error) {
+	raw := doc.RawContent
+	if raw == nil {
+		switch content := doc.Content.(type) {
+		case json.RawMessage:
+			raw = content
+		case string:
+			raw = []byte(content)
+		default:
+			b, err := json.Marshal(content)
+			if err != nil {
+				return nil, err
+			}
+			raw = b
+		}
+	}
+
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// TemplateStrategy builds the IDs from content fields
+type TemplateStrategy struct {
+	literals []string
+	fields   [][]string
+}
+
+// NewTemplateStrategy returns a TemplateStrategy from a template where {field} is replaced by
+// the value of a content field, nested fields are separated by dots: "{user.id}-{date}"
+func NewTemplateStrategy(template string) (*TemplateStrategy, error) {
+	s := &TemplateStrategy{}
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			s.literals = append(s.literals, rest)
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated field in ID template '%s'", template)
+		}
+		field := rest[start+1 : start+end]
+		if field == "" {
+			return nil, fmt.Errorf("empty field in ID template '%s'", template)
+		}
+		s.literals = append(s.literals, rest[:start])
+		s.fields = append(s.fields, strings.Split(field, "."))
+		rest = rest[start+end+1:]
+	}
+	if len(s.fields) == 0 {
+		return nil, fmt.Errorf("no field in ID template '%s'", template)
+	}
+	return s, nil
+}
+
+// GenerateID implements IDStrategy
+func (s *TemplateStrategy) GenerateID(doc *Document) (string, error) {
+	content, err := decodeContent(doc)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for i, path := range s.fields {
+		b.WriteString(s.literals[i])
+		v := content
+		for _, key := range path {
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				v = nil
+				break
+			}
+			v = obj[key]
+		}
+
+		switch value := v.(type) {
+		case string:
+			b.WriteString(value)
+		case json.Number:
+			b.WriteString(value.String())
+		case bool:
+			fmt.Fprint(&b, value)
+		case nil:
+			return "", fmt.Errorf("field %s is missing", strings.Join(path, "."))
+		default:
+			return "", fmt.Errorf("field %s is not a scalar", strings.Join(path, "."))
+		}
+	}
+	b.WriteString(s.literals[len(s.fields)])
+	return b.String(), nil
+}
+
+// ID strategies names of the workgroup configuration
+const (
+	IDStrategyAuto        = "auto"
+	IDStrategyUUID        = "uuid"
+	IDStrategyULID        = "ulid"
+	IDStrategyContentHash = "content-hash"
+	IDStrategyTemplate    = "template"
+)
+
+// newIDStrategy returns the ID strategy of the configuration, nil if not set
+func newIDStrategy(wcfg WorkgroupConfig) (IDStrategy, error) {
+	switch wcfg.IDStrategy {
+	case "":
+		return nil, nil
+	case IDStrategyAuto:
+		return AutoIDStrategy{}, nil
+	case IDStrategyUUID:
+		return UUIDStrategy{}, nil
+	case IDStrategyULID:
+		return NewULIDStrategy(), nil
+	case IDStrategyContentHash:
+		return ContentHashStrategy{}, nil
+	case IDStrategyTemplate:
+		return NewTemplateStrategy(wcfg.IDTemplate)
+	}
+	return nil, fmt.Errorf("unknown ID strategy '%s'", wcfg.IDStrategy)
+}
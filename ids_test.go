@@ -0,0 +1,166 @@
+package elasticwg
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAutoIDStrategy(t *testing.T) {
+	id, err := AutoIDStrategy{}.GenerateID(&Document{})
+	assert.Nil(t, err)
+	assert.Empty(t, id)
+}
+
+func TestUUIDStrategy(t *testing.T) {
+	uuidV4 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id, err := UUIDStrategy{}.GenerateID(&Document{})
+		assert.Nil(t, err)
+		assert.Regexp(t, uuidV4, id)
+		assert.False(t, seen[id])
+		seen[id] = true
+	}
+}
+
+func TestULIDStrategy(t *testing.T) {
+	now := time.Unix(1469918176, 385000000)
+	s := NewULIDStrategy()
+	s.now = func() time.Time {
+		return now
+	}
+
+	// The timestamp is encoded in the first 10 characters
+	id, err := s.GenerateID(&Document{})
+	assert.Nil(t, err)
+	assert.Len(t, id, 26)
+	assert.Equal(t, "01ARYZ6S41", id[:10])
+
+	// IDs are sorted within a millisecond & across milliseconds, even if the clock goes back
+	ids := []string{id}
+	for i := 0; i < 100; i++ {
+		switch i {
+		case 50:
+			now = now.Add(time.Millisecond)
+		case 70:
+			now = now.Add(-time.Second)
+		}
+		id, err := s.GenerateID(&Document{})
+		assert.Nil(t, err)
+		ids = append(ids, id)
+	}
+	assert.True(t, sort.StringsAreSorted(ids))
+
+	s.entropy = [10]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	_, err = s.GenerateID(&Document{})
+	assert.NotNil(t, err)
+
+	// The zero value uses the current time
+	id, err = (&ULIDStrategy{}).GenerateID(&Document{})
+	assert.Nil(t, err)
+	assert.Len(t, id, 26)
+}
+
+func TestULIDStrategy_Concurrent(t *testing.T) {
+	s := NewULIDStrategy()
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				id, err := s.GenerateID(&Document{})
+				assert.Nil(t, err)
+				mu.Lock()
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, seen, 4000)
+}
+
+func TestContentHashStrategy(t *testing.T) {
+	type content struct {
+		B int    `json:"b"`
+		A string `json:"a"`
+	}
+
+	expected, err := ContentHashStrategy{}.GenerateID(&Document{Content: content{B: 1, A: "x"}})
+	assert.Nil(t, err)
+	assert.Len(t, expected, 64)
+
+	// The same content gets the same ID, whatever its keys order & spacing
+	for _, doc := range []*Document{
+		{Content: map[string]interface{}{"a": "x", "b": 1}},
+		{Content: json.RawMessage(`{ "b": 1, "a": "x" }`)},
+		{Content: `{"a":"x","b":1}`},
+		{RawContent: []byte(`{"b":1,  "a":"x"}`), Content: "ignored"},
+	} {
+		id, err := ContentHashStrategy{}.GenerateID(doc)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, id)
+	}
+
+	id, err := ContentHashStrategy{}.GenerateID(&Document{Content: content{B: 2, A: "x"}})
+	assert.Nil(t, err)
+	assert.NotEqual(t, expected, id)
+
+	_, err = ContentHashStrategy{}.GenerateID(&Document{RawContent: []byte(`{`)})
+	assert.NotNil(t, err)
+}
+
+func TestTemplateStrategy(t *testing.T) {
+	s, err := NewTemplateStrategy("{user.id}-{date}/{count}:{ok}")
+	assert.Nil(t, err)
+
+	id, err := s.GenerateID(&Document{Content: map[string]interface{}{
+		"user":  map[string]interface{}{"id": "u1"},
+		"date":  "2019-01-01",
+		"count": 12345678901,
+		"ok":    true,
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, "u1-2019-01-01/12345678901:true", id)
+
+	_, err = s.GenerateID(&Document{Content: map[string]interface{}{"date": "2019-01-01"}})
+	assert.NotNil(t, err)
+	_, err = s.GenerateID(&Document{Content: map[string]interface{}{
+		"user": map[string]interface{}{"id": []int{1}},
+	}})
+	assert.NotNil(t, err)
+
+	for _, template := range []string{"", "static", "{unterminated", "{}-{a}"} {
+		_, err := NewTemplateStrategy(template)
+		assert.NotNil(t, err, template)
+	}
+}
+
+func TestProducer_PushIDStrategy(t *testing.T) {
+	s, err := NewTemplateStrategy("{name}")
+	assert.Nil(t, err)
+	p := Producer{idStrategy: s, stats: &runStats{}}
+	p.c = make(chan *Document, 3)
+
+	p.Push(&Document{Content: map[string]string{"name": "generated"}})
+	p.Push(&Document{ID: "kept", Content: map[string]string{"name": "generated"}})
+	// Documents the strategy fails on are rejected
+	p.Push(&Document{Content: map[string]string{}})
+	close(p.c)
+
+	var ids []string
+	for doc := range p.c {
+		ids = append(ids, doc.ID)
+	}
+	assert.Equal(t, []string{"generated", "kept"}, ids)
+	assert.Equal(t, uint64(2), p.stats.getProduced())
+	assert.Equal(t, uint64(1), p.stats.getRejected())
+}
@@ -1,5 +1,10 @@
 package elasticwg
 
+import (
+	"fmt"
+	"strings"
+)
+
 // Logger logging interface intended to be implemented for this library
 type Logger interface {
 	Info(format string, args ...interface{})
@@ -9,3 +14,77 @@ type Logger interface {
 	Error(format string, args ...interface{})
 	Errorf(format string, args ...interface{})
 }
+
+// Field a key/value pair attached to a structured log line
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F creates a Field
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// StructuredLogger leveled & field-based logging interface intended to be implemented for this library
+// With returns a logger adding fields to each line, the workgroup uses it to attach
+// the index, run ID & consumer ID
+type StructuredLogger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+	With(fields ...Field) StructuredLogger
+}
+
+// FromLogger wraps a printf-style Logger, such as a go-logging one, into a StructuredLogger
+// Fields are appended to the message as key=value pairs. Logger has no debug level,
+// debug lines are dropped
+func FromLogger(l Logger) StructuredLogger {
+	if l == nil {
+		return nil
+	}
+
+	return &printfLogger{logger: l}
+}
+
+type printfLogger struct {
+	logger Logger
+	fields []Field
+}
+
+func (l *printfLogger) format(msg string, fields []Field) string {
+	if len(l.fields) == 0 && len(fields) == 0 {
+		return msg
+	}
+
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, list := range [][]Field{fields, l.fields} {
+		for _, f := range list {
+			fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+		}
+	}
+	return b.String()
+}
+
+func (l *printfLogger) Debug(string, ...Field) {}
+
+func (l *printfLogger) Info(msg string, fields ...Field) {
+	l.logger.Infof("%s", l.format(msg, fields))
+}
+
+func (l *printfLogger) Warn(msg string, fields ...Field) {
+	l.logger.Warningf("%s", l.format(msg, fields))
+}
+
+func (l *printfLogger) Error(msg string, fields ...Field) {
+	l.logger.Errorf("%s", l.format(msg, fields))
+}
+
+func (l *printfLogger) With(fields ...Field) StructuredLogger {
+	all := make([]Field, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+	return &printfLogger{logger: l.logger, fields: all}
+}
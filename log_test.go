@@ -0,0 +1,64 @@
+package elasticwg
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type testRecordLogger struct {
+	lines []string
+}
+
+func (l *testRecordLogger) record(level string, format string, args ...interface{}) {
+	l.lines = append(l.lines, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *testRecordLogger) Info(format string, args ...interface{}) {
+	l.record("INFO", format, args...)
+}
+func (l *testRecordLogger) Infof(format string, args ...interface{}) {
+	l.record("INFO", format, args...)
+}
+func (l *testRecordLogger) Warning(format string, args ...interface{}) {
+	l.record("WARNING", format, args...)
+}
+func (l *testRecordLogger) Warningf(format string, args ...interface{}) {
+	l.record("WARNING", format, args...)
+}
+func (l *testRecordLogger) Error(format string, args ...interface{}) {
+	l.record("ERROR", format, args...)
+}
+func (l *testRecordLogger) Errorf(format string, args ...interface{}) {
+	l.record("ERROR", format, args...)
+}
+
+func TestFromLogger(t *testing.T) {
+	assert.Nil(t, FromLogger(nil))
+
+	rl := &testRecordLogger{}
+	l := FromLogger(rl)
+	l.Info("no fields")
+	l.Debug("dropped", F("k", "v"))
+
+	cl := l.With(F("index", "idx"), F("run_id", "42")).With(F("consumer_id", 3))
+	cl.Warn("Failed to perform a bulk query", F("attempt", 2))
+	cl.Error("100% failure")
+
+	assert.Equal(t, []string{
+		"INFO no fields",
+		"WARNING Failed to perform a bulk query attempt=2 index=idx run_id=42 consumer_id=3",
+		"ERROR 100% failure index=idx run_id=42 consumer_id=3",
+	}, rl.lines)
+}
+
+func TestWorkgroup_SetStructuredLogger(t *testing.T) {
+	wg := NewWorkgroup(esURL, testCfg, &testProducer{}, gTestLogger)
+	wg.SetStructuredLogger(nil)
+	assert.NotNil(t, wg.log)
+
+	rl := &testRecordLogger{}
+	wg.SetStructuredLogger(FromLogger(rl))
+	assert.False(t, wg.SetIndexMappingFromFile("ci/mapping_test_unkfile.json"))
+	assert.Len(t, rl.lines, 1)
+}
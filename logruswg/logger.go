@@ -0,0 +1,48 @@
+// Package logruswg adapts a logrus logger to elasticwg.StructuredLogger
+package logruswg
+
+import (
+	"github.com/sirupsen/logrus"
+	"gitlab.com/thundersnake/elasticwg"
+)
+
+type logger struct {
+	entry *logrus.Entry
+}
+
+// New wraps l into an elasticwg.StructuredLogger
+func New(l logrus.FieldLogger) elasticwg.StructuredLogger {
+	return &logger{entry: l.WithFields(logrus.Fields{})}
+}
+
+func (l *logger) withFields(fields []elasticwg.Field) *logrus.Entry {
+	if len(fields) == 0 {
+		return l.entry
+	}
+
+	f := make(logrus.Fields, len(fields))
+	for _, field := range fields {
+		f[field.Key] = field.Value
+	}
+	return l.entry.WithFields(f)
+}
+
+func (l *logger) Debug(msg string, fields ...elasticwg.Field) {
+	l.withFields(fields).Debug(msg)
+}
+
+func (l *logger) Info(msg string, fields ...elasticwg.Field) {
+	l.withFields(fields).Info(msg)
+}
+
+func (l *logger) Warn(msg string, fields ...elasticwg.Field) {
+	l.withFields(fields).Warn(msg)
+}
+
+func (l *logger) Error(msg string, fields ...elasticwg.Field) {
+	l.withFields(fields).Error(msg)
+}
+
+func (l *logger) With(fields ...elasticwg.Field) elasticwg.StructuredLogger {
+	return &logger{entry: l.withFields(fields)}
+}
@@ -0,0 +1,23 @@
+package logruswg
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/thundersnake/elasticwg"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	l, hook := test.NewNullLogger()
+	sl := New(l)
+
+	sl.With(elasticwg.F("index", "idx")).Info("Consuming finished", elasticwg.F("documents", 250))
+	sl.Debug("hidden")
+
+	assert.Len(t, hook.AllEntries(), 1)
+	entry := hook.LastEntry()
+	assert.Equal(t, logrus.InfoLevel, entry.Level)
+	assert.Equal(t, "Consuming finished", entry.Message)
+	assert.Equal(t, logrus.Fields{"index": "idx", "documents": 250}, entry.Data)
+}
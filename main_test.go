@@ -1,7 +1,13 @@
 package elasticwg
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/op/go-logging"
+	"gopkg.in/olivere/elastic.v5"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 )
@@ -16,3 +22,52 @@ func TestMain(m *testing.M) {
 	// Deinit code
 	os.Exit(code)
 }
+
+// testBulkHooks customizes the answers of a test bulk server
+type testBulkHooks struct {
+	// status returns the status of the whole bulk request given its body, 0 to answer it
+	status func(body []byte) int
+	// item sets the result of the item answering an action, indexed if left unchanged
+	item func(item *elastic.BulkResponseItem)
+}
+
+// newHookedBulkServer returns a test server answering bulk requests with an item per action, through hooks
+func newHookedBulkServer(hooks testBulkHooks) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := elastic.BulkResponse{}
+		if r.URL.Path == "/_bulk" {
+			body, _ := ioutil.ReadAll(r.Body)
+			if hooks.status != nil {
+				if status := hooks.status(body); status != 0 {
+					w.WriteHeader(status)
+					return
+				}
+			}
+
+			lines := bytes.Split(bytes.TrimSpace(body), []byte("\n"))
+			for i := 0; i < len(lines); i += 2 {
+				var action map[string]elastic.BulkResponseItem
+				json.Unmarshal(lines[i], &action)
+				item := action["index"]
+				item.Status = http.StatusCreated
+				if hooks.item != nil {
+					hooks.item(&item)
+				}
+				res.Items = append(res.Items, map[string]*elastic.BulkResponseItem{"index": &item})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}))
+}
+
+// newTestBulkServer returns a test server answering bulk requests with an item per action,
+// indexed unless reject returns true for its ID
+func newTestBulkServer(reject func(id string) bool) *httptest.Server {
+	return newHookedBulkServer(testBulkHooks{item: func(item *elastic.BulkResponseItem) {
+		if reject != nil && reject(item.Id) {
+			item.Status = http.StatusBadRequest
+			item.Error = &elastic.ErrorDetails{Type: "mapper_parsing_exception"}
+		}
+	}})
+}
@@ -0,0 +1,131 @@
+package elasticwg
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// memoryBudget bounds the bytes of the documents pushed by the producer & not yet sent to Elasticsearch
+// While the producer waits for memory, consumers flush their partial bulks to release it
+type memoryBudget struct {
+	mu        sync.Mutex
+	capacity  int64
+	used      int64
+	peak      int64
+	starved   bool
+	cStarved  chan struct{}
+	cReleased chan struct{}
+}
+
+func newMemoryBudget(capacity int64) *memoryBudget {
+	if capacity <= 0 {
+		return nil
+	}
+
+	return &memoryBudget{
+		capacity:  capacity,
+		cStarved:  make(chan struct{}),
+		cReleased: make(chan struct{}),
+	}
+}
+
+// acquire blocks until n bytes are available or ctx is done
+// A document larger than the budget is accepted once all the memory has been released
+func (b *memoryBudget) acquire(ctx context.Context, n int64) error {
+	if b == nil {
+		return nil
+	}
+
+	for {
+		b.mu.Lock()
+		if b.used == 0 || b.used+n <= b.capacity {
+			b.used += n
+			if b.used > b.peak {
+				b.peak = b.used
+			}
+			if b.starved {
+				b.starved = false
+				b.cStarved = make(chan struct{})
+			}
+			b.mu.Unlock()
+			return nil
+		}
+
+		if !b.starved {
+			b.starved = true
+			close(b.cStarved)
+		}
+		cReleased := b.cReleased
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-cReleased:
+		}
+	}
+}
+
+func (b *memoryBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	close(b.cReleased)
+	b.cReleased = make(chan struct{})
+}
+
+// starvedChan returns a channel closed while the producer waits for memory
+func (b *memoryBudget) starvedChan() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cStarved
+}
+
+// getPeak returns the high-water mark of the used memory
+func (b *memoryBudget) getPeak() int64 {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.peak
+}
+
+// documentSize estimates the memory held by doc until it is sent
+// Contents are encoded with enc, or encoding/json if not set, & kept so consumers don't encode them again
+func documentSize(doc *Document, enc Encoder) int64 {
+	size := int64(len(doc.ID))
+	if doc.RawContent != nil {
+		return size + int64(len(doc.RawContent))
+	}
+	if doc.encoded != nil {
+		return size + int64(len(doc.encoded))
+	}
+
+	switch content := doc.Content.(type) {
+	case json.RawMessage:
+		size += int64(len(content))
+	case string:
+		size += int64(len(content))
+	default:
+		if enc == nil {
+			enc = JSONEncoder{}
+		}
+		// Encoding errors are reported by the consumer
+		if b, err := enc.Encode(content); err == nil {
+			doc.encoded = b
+			size += int64(len(b))
+		}
+	}
+	return size
+}
@@ -0,0 +1,70 @@
+package elasticwg
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	assert.Nil(t, newMemoryBudget(0))
+
+	var unlimited *memoryBudget
+	assert.Nil(t, unlimited.acquire(context.Background(), 1<<30))
+	unlimited.release(1 << 30)
+	assert.Nil(t, unlimited.starvedChan())
+	assert.Equal(t, int64(0), unlimited.getPeak())
+
+	b := newMemoryBudget(100)
+	assert.Nil(t, b.acquire(context.Background(), 60))
+	assert.Nil(t, b.acquire(context.Background(), 40))
+
+	cStarved := b.starvedChan()
+	cDone := make(chan error)
+	go func() {
+		cDone <- b.acquire(context.Background(), 50)
+	}()
+
+	// Consumers are told to flush their partial bulks
+	select {
+	case <-cStarved:
+	case <-time.After(time.Second):
+		t.Fatal("budget not starved")
+	}
+
+	b.release(60)
+	assert.Nil(t, <-cDone)
+	assert.Equal(t, int64(100), b.getPeak())
+
+	select {
+	case <-b.starvedChan():
+		t.Fatal("budget still starved")
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, b.acquire(ctx, 50))
+}
+
+func TestMemoryBudget_LargeDocument(t *testing.T) {
+	b := newMemoryBudget(100)
+
+	// Accepted once all the memory has been released
+	assert.Nil(t, b.acquire(context.Background(), 500))
+	assert.Equal(t, int64(500), b.getPeak())
+	b.release(500)
+}
+
+func TestDocumentSize(t *testing.T) {
+	assert.Equal(t, int64(9), documentSize(&Document{ID: "12", Content: json.RawMessage(`{"a":1}`)}, nil))
+	assert.Equal(t, int64(7), documentSize(&Document{RawContent: []byte(`{"a":1}`)}, nil))
+	assert.Equal(t, int64(7), documentSize(&Document{Content: `{"a":1}`}, nil))
+
+	// Encoded contents are kept for the consumers
+	doc := &Document{Content: map[string]string{"a": "b"}}
+	assert.Equal(t, int64(9), documentSize(doc, nil))
+	assert.Equal(t, `{"a":"b"}`, string(doc.encoded))
+}
@@ -0,0 +1,44 @@
+package elasticwg
+
+import "time"
+
+// Outcome the state of a document or a bulk request reported to Metrics
+type Outcome string
+
+const (
+	// OutcomeProduced documents pushed by the producer or bulk requests sent by consumers
+	OutcomeProduced Outcome = "produced"
+	// OutcomeIndexed documents or bulk requests accepted by Elasticsearch
+	OutcomeIndexed Outcome = "indexed"
+	// OutcomeRejected documents or bulk requests refused by Elasticsearch or given up
+	OutcomeRejected Outcome = "rejected"
+	// OutcomeRetried documents or bulk requests sent again after a failure
+	OutcomeRetried Outcome = "retried"
+	// OutcomeSkipped documents left out by the incremental mode because they didn't change
+	OutcomeSkipped Outcome = "skipped"
+	// OutcomeFailedOver documents or bulk requests accepted by the failover cluster
+	OutcomeFailedOver Outcome = "failed_over"
+)
+
+// Metrics metrics collection interface intended to be implemented for this library
+// All the methods are called concurrently by the producer & the consumers
+// SetBulkSettings reports the bulk size & the consumers allowed to send bulk requests,
+// changed by the adaptive mode while running
+type Metrics interface {
+	AddDocuments(index string, outcome Outcome, n int)
+	AddBulks(index string, outcome Outcome, n int)
+	ObserveBulk(index string, latency time.Duration, bytes int64)
+	SetChannelOccupancy(index string, n int)
+	AddActiveConsumers(index string, delta int)
+	SetBulkSettings(index string, bulkSize, consumers int)
+}
+
+// nopMetrics the Metrics used when none is set on the workgroup
+type nopMetrics struct{}
+
+func (nopMetrics) AddDocuments(string, Outcome, int)        {}
+func (nopMetrics) AddBulks(string, Outcome, int)            {}
+func (nopMetrics) ObserveBulk(string, time.Duration, int64) {}
+func (nopMetrics) SetChannelOccupancy(string, int)          {}
+func (nopMetrics) AddActiveConsumers(string, int)           {}
+func (nopMetrics) SetBulkSettings(string, int, int)         {}
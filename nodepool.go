@@ -0,0 +1,168 @@
+package elasticwg
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// BalancingRoundRobin distribute requests in turn on each alive node
+	BalancingRoundRobin = "round-robin"
+	// BalancingLeastLoaded send each request to the alive node with the fewest requests in flight
+	BalancingLeastLoaded = "least-loaded"
+
+	defaultHealthcheckInterval = 10 * time.Second
+)
+
+// poolNode an Elasticsearch node known by the nodePool
+type poolNode struct {
+	url      *url.URL
+	inFlight int64
+	dead     int32
+}
+
+func (n *poolNode) isDead() bool {
+	return atomic.LoadInt32(&n.dead) == 1
+}
+
+// nodePool is an http.RoundTripper distributing requests on a set of nodes
+// Nodes failing at transport level are marked dead & revived by a periodic health check
+type nodePool struct {
+	base     http.RoundTripper
+	nodes    []*poolNode
+	balancer string
+	next     uint64
+	interval time.Duration
+	stopOnce sync.Once
+	cStop    chan struct{}
+}
+
+func newNodePool(urls []string, balancer string, interval time.Duration, base http.RoundTripper) (*nodePool, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if interval <= 0 {
+		interval = defaultHealthcheckInterval
+	}
+
+	p := &nodePool{
+		base:     base,
+		balancer: balancer,
+		interval: interval,
+		cStop:    make(chan struct{}),
+	}
+
+	for _, u := range urls {
+		nodeURL, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		p.nodes = append(p.nodes, &poolNode{url: nodeURL})
+	}
+
+	go p.healthcheckLoop()
+	return p, nil
+}
+
+// pick returns the node to send the next request to
+// If all nodes are dead, they are all considered as candidates
+func (p *nodePool) pick() *poolNode {
+	alive := make([]*poolNode, 0, len(p.nodes))
+	for _, n := range p.nodes {
+		if !n.isDead() {
+			alive = append(alive, n)
+		}
+	}
+
+	if len(alive) == 0 {
+		alive = p.nodes
+	}
+
+	if p.balancer == BalancingLeastLoaded {
+		best := alive[0]
+		for _, n := range alive[1:] {
+			if atomic.LoadInt64(&n.inFlight) < atomic.LoadInt64(&best.inFlight) {
+				best = n
+			}
+		}
+		return best
+	}
+
+	return alive[int(atomic.AddUint64(&p.next, 1)-1)%len(alive)]
+}
+
+// RoundTrip implements http.RoundTripper
+func (p *nodePool) RoundTrip(req *http.Request) (*http.Response, error) {
+	n := p.pick()
+
+	r := new(http.Request)
+	*r = *req
+	u := *req.URL
+	u.Scheme = n.url.Scheme
+	u.Host = n.url.Host
+	r.URL = &u
+	r.Host = n.url.Host
+
+	atomic.AddInt64(&n.inFlight, 1)
+	res, err := p.base.RoundTrip(r)
+	atomic.AddInt64(&n.inFlight, -1)
+
+	if err != nil && req.Context().Err() == nil {
+		atomic.StoreInt32(&n.dead, 1)
+	}
+
+	return res, err
+}
+
+// healthcheckLoop periodically tries to revive dead nodes
+func (p *nodePool) healthcheckLoop() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.cStop:
+			return
+		case <-ticker.C:
+			for _, n := range p.nodes {
+				if n.isDead() && p.healthcheck(n) {
+					atomic.StoreInt32(&n.dead, 0)
+				}
+			}
+		}
+	}
+}
+
+func (p *nodePool) healthcheck(n *poolNode) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+	defer cancel()
+
+	req, err := http.NewRequest("HEAD", n.url.String(), nil)
+	if err != nil {
+		return false
+	}
+
+	res, err := p.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+
+	return res.StatusCode < 500
+}
+
+// Stop stops the health check loop
+func (p *nodePool) Stop() {
+	if p == nil {
+		return
+	}
+
+	p.stopOnce.Do(func() {
+		close(p.cStop)
+	})
+}
@@ -0,0 +1,84 @@
+package elasticwg
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCountingServer(counter *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(counter, 1)
+	}))
+}
+
+func TestNodePool_RoundRobin(t *testing.T) {
+	var c1, c2 int64
+	s1 := newCountingServer(&c1)
+	defer s1.Close()
+	s2 := newCountingServer(&c2)
+	defer s2.Close()
+
+	p, err := newNodePool([]string{s1.URL, s2.URL}, BalancingRoundRobin, time.Hour, nil)
+	assert.Nil(t, err)
+	defer p.Stop()
+
+	client := &http.Client{Transport: p}
+	for i := 0; i < 10; i++ {
+		res, err := client.Get("http://placeholder/_bulk")
+		assert.Nil(t, err)
+		res.Body.Close()
+	}
+
+	assert.Equal(t, int64(5), c1)
+	assert.Equal(t, int64(5), c2)
+}
+
+func TestNodePool_LeastLoaded(t *testing.T) {
+	p, err := newNodePool([]string{"http://node1:9200", "http://node2:9200"}, BalancingLeastLoaded, time.Hour, nil)
+	assert.Nil(t, err)
+	defer p.Stop()
+
+	p.nodes[0].inFlight = 3
+	assert.Equal(t, "node2:9200", p.pick().url.Host)
+
+	p.nodes[1].inFlight = 4
+	assert.Equal(t, "node1:9200", p.pick().url.Host)
+}
+
+// flakyTransport fails at transport level while down is set
+type flakyTransport struct {
+	down int32
+}
+
+func (t *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadInt32(&t.down) == 1 {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+}
+
+func TestNodePool_DeadNodeRevival(t *testing.T) {
+	ft := &flakyTransport{down: 1}
+	p, err := newNodePool([]string{"http://node1:9200"}, BalancingRoundRobin, 20*time.Millisecond, ft)
+	assert.Nil(t, err)
+	defer p.Stop()
+
+	_, err = p.RoundTrip(httptest.NewRequest("GET", "http://placeholder/", nil))
+	assert.NotNil(t, err)
+	assert.True(t, p.nodes[0].isDead())
+
+	// The dead node now answers to the health check
+	atomic.StoreInt32(&ft.down, 0)
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, p.nodes[0].isDead())
+}
+
+func TestNewElasticClientUnknownBalancing(t *testing.T) {
+	_, _, err := newElasticClient(esURL, ConnectionConfig{Balancing: "random"}, nil, nil)
+	assert.NotNil(t, err)
+}
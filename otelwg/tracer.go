@@ -0,0 +1,91 @@
+// Package otelwg provides an OpenTelemetry implementation of elasticwg.Tracer
+package otelwg
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/thundersnake/elasticwg"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+const instrumentationName = "gitlab.com/thundersnake/elasticwg"
+
+// Tracer OpenTelemetry tracer used by an elasticwg workgroup
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewTracer creates a tracer from tp & propagator
+// When nil, the global tracer provider & propagator are used
+func NewTracer(tp trace.TracerProvider, propagator propagation.TextMapPropagator) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+
+	if propagator == nil {
+		propagator = otel.GetTextMapPropagator()
+	}
+
+	return &Tracer{
+		tracer:     tp.Tracer(instrumentationName),
+		propagator: propagator,
+	}
+}
+
+// Start implements elasticwg.Tracer
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...elasticwg.Attribute) (context.Context, elasticwg.Span) {
+	ctx, s := t.tracer.Start(ctx, name, trace.WithAttributes(convert(attrs)...))
+	return ctx, &span{span: s}
+}
+
+// Inject implements elasticwg.Tracer
+func (t *Tracer) Inject(ctx context.Context, header http.Header) {
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+type span struct {
+	span trace.Span
+}
+
+func (s *span) SetAttributes(attrs ...elasticwg.Attribute) {
+	s.span.SetAttributes(convert(attrs)...)
+}
+
+func (s *span) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *span) End() {
+	s.span.End()
+}
+
+// convert maps elasticwg attributes to OpenTelemetry ones, unknown types are formatted as strings
+func convert(attrs []elasticwg.Attribute) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		switch v := a.Value.(type) {
+		case string:
+			kvs = append(kvs, attribute.String(a.Key, v))
+		case int:
+			kvs = append(kvs, attribute.Int(a.Key, v))
+		case int64:
+			kvs = append(kvs, attribute.Int64(a.Key, v))
+		case uint64:
+			kvs = append(kvs, attribute.Int64(a.Key, int64(v)))
+		case float64:
+			kvs = append(kvs, attribute.Float64(a.Key, v))
+		case bool:
+			kvs = append(kvs, attribute.Bool(a.Key, v))
+		default:
+			kvs = append(kvs, attribute.String(a.Key, fmt.Sprint(v)))
+		}
+	}
+	return kvs
+}
@@ -0,0 +1,51 @@
+package otelwg
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/thundersnake/elasticwg"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"testing"
+)
+
+func newTestTracer() (*Tracer, *tracetest.SpanRecorder) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	return NewTracer(tp, propagation.TraceContext{}), sr
+}
+
+func TestTracer_Start(t *testing.T) {
+	tracer, sr := newTestTracer()
+
+	ctx, root := tracer.Start(context.Background(), "elasticwg.Run", elasticwg.Attribute{Key: "elasticwg.index", Value: "idx"})
+	_, child := tracer.Start(ctx, "elasticwg.Bulk", elasticwg.Attribute{Key: "elasticwg.bulk.actions", Value: 500})
+	child.SetAttributes(elasticwg.Attribute{Key: "elasticwg.bulk.failed_items", Value: 2})
+	child.RecordError(errors.New("failure"))
+	child.End()
+	root.End()
+
+	spans := sr.Ended()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "elasticwg.Bulk", spans[0].Name())
+	assert.Equal(t, spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Contains(t, spans[0].Attributes(), attribute.Int("elasticwg.bulk.failed_items", 2))
+	assert.Contains(t, spans[1].Attributes(), attribute.String("elasticwg.index", "idx"))
+}
+
+func TestTracer_Inject(t *testing.T) {
+	tracer, _ := newTestTracer()
+
+	ctx, s := tracer.Start(context.Background(), "elasticwg.Run")
+	defer s.End()
+
+	header := http.Header{}
+	tracer.Inject(ctx, header)
+	assert.NotEmpty(t, header.Get("traceparent"))
+}
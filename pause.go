@@ -0,0 +1,95 @@
+package elasticwg
+
+import (
+	"context"
+	"sync"
+)
+
+const pauseReasonManual = "manual"
+
+// pauseGate blocks consumers while at least one pause reason is set, on the gate or its parent
+type pauseGate struct {
+	parent  *pauseGate
+	mu      sync.Mutex
+	reasons map[string]struct{}
+	cResume chan struct{}
+}
+
+func newPauseGate() *pauseGate {
+	cResume := make(chan struct{})
+	close(cResume)
+	return &pauseGate{
+		reasons: make(map[string]struct{}),
+		cResume: cResume,
+	}
+}
+
+// child returns a gate of its own, also blocking while g is paused
+// Each target has one, so its breaker only pauses its consumers while a run pause applies to all of them
+func (g *pauseGate) child() *pauseGate {
+	c := newPauseGate()
+	c.parent = g
+	return c
+}
+
+func (g *pauseGate) pause(reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.reasons) == 0 {
+		g.cResume = make(chan struct{})
+	}
+	g.reasons[reason] = struct{}{}
+}
+
+func (g *pauseGate) resume(reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.reasons[reason]; !ok {
+		return
+	}
+
+	delete(g.reasons, reason)
+	if len(g.reasons) == 0 {
+		close(g.cResume)
+	}
+}
+
+func (g *pauseGate) paused() bool {
+	if g == nil {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.reasons) > 0 || g.parent.paused()
+}
+
+// wait blocks until the gate is open or ctx is done
+func (g *pauseGate) wait(ctx context.Context) error {
+	if g == nil {
+		return ctx.Err()
+	}
+
+	for {
+		if err := g.parent.wait(ctx); err != nil {
+			return err
+		}
+
+		g.mu.Lock()
+		cResume := g.cResume
+		g.mu.Unlock()
+
+		select {
+		case <-cResume:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		// The parent may have been paused meanwhile
+		if !g.parent.paused() {
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package elasticwg
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPauseGate(t *testing.T) {
+	g := newPauseGate()
+	assert.False(t, g.paused())
+	assert.Nil(t, g.wait(context.Background()))
+
+	g.pause(pauseReasonManual)
+	g.pause("other")
+	assert.True(t, g.paused())
+
+	// Still paused while a reason is left
+	g.resume(pauseReasonManual)
+	g.resume(pauseReasonManual)
+	assert.True(t, g.paused())
+
+	cDone := make(chan error)
+	go func() {
+		cDone <- g.wait(context.Background())
+	}()
+
+	select {
+	case <-cDone:
+		t.Fatal("wait returned while the gate is paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	g.resume("other")
+	assert.False(t, g.paused())
+	assert.Nil(t, <-cDone)
+}
+
+func TestPauseGate_WaitCanceled(t *testing.T) {
+	g := newPauseGate()
+	g.pause(pauseReasonManual)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, g.wait(ctx))
+
+	var nilGate *pauseGate
+	assert.Nil(t, nilGate.wait(context.Background()))
+}
+
+func TestPauseGate_Child(t *testing.T) {
+	g := newPauseGate()
+	primary, mirror := g.child(), g.child()
+
+	// A target pause only blocks its own consumers
+	mirror.pause(pauseReasonBreaker)
+	assert.True(t, mirror.paused())
+	assert.False(t, primary.paused())
+	assert.Nil(t, primary.wait(context.Background()))
+
+	// A run pause blocks all of them
+	g.pause(pauseReasonManual)
+	assert.True(t, primary.paused())
+
+	cDone := make(chan error)
+	go func() {
+		cDone <- primary.wait(context.Background())
+	}()
+
+	select {
+	case <-cDone:
+		t.Fatal("wait returned while the parent gate is paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	g.resume(pauseReasonManual)
+	assert.Nil(t, <-cDone)
+	assert.True(t, mirror.paused())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, mirror.wait(ctx))
+}
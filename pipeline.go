@@ -0,0 +1,105 @@
+package elasticwg
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// semaphore limits concurrent operations, a nil semaphore doesn't limit anything
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// bulkPipeline sends the bulk requests of a consumer in background, up to its maximum in flight,
+// & accounts for them in the order they were built so callbacks & events keep their order
+type bulkPipeline struct {
+	c        *Consumer
+	slots    semaphore
+	wg       sync.WaitGroup
+	prevDone chan struct{}
+	failed   int32
+}
+
+func newBulkPipeline(c *Consumer) *bulkPipeline {
+	prevDone := make(chan struct{})
+	close(prevDone)
+	return &bulkPipeline{
+		c:        c,
+		slots:    newSemaphore(c.maxInFlight),
+		prevDone: prevDone,
+	}
+}
+
+// push sends body in background once a slot is free, & releases its buffer & the memory of its documents
+// It returns false if an earlier bulk request has been given up
+func (p *bulkPipeline) push(body *bulkBody, bytes int64) bool {
+	if atomic.LoadInt32(&p.failed) != 0 {
+		p.c.bulkFailed(body, 0)
+		body.release()
+		p.c.budget.release(bytes)
+		return false
+	}
+	if err := p.slots.acquire(p.c.getContext()); err != nil {
+		p.c.setErr(err)
+		p.c.bulkFailed(body, 0)
+		body.release()
+		p.c.budget.release(bytes)
+		return false
+	}
+
+	prev, done := p.prevDone, make(chan struct{})
+	p.prevDone = done
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer p.slots.release()
+		defer close(done)
+
+		result, ok := p.c.sendBulk(body)
+		body.release()
+		p.c.budget.release(bytes)
+		if !ok {
+			atomic.StoreInt32(&p.failed, 1)
+		}
+
+		// Wait for the previous bulk request to be accounted
+		<-prev
+		p.c.bulkSent(result)
+		if !ok {
+			p.c.bulkFailed(body, result.sentActions())
+		}
+	}()
+	return true
+}
+
+// wait blocks until all the bulk requests are done & returns false if one has been given up
+func (p *bulkPipeline) wait() bool {
+	p.wg.Wait()
+	return atomic.LoadInt32(&p.failed) == 0
+}
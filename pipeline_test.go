@@ -0,0 +1,151 @@
+package elasticwg
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSemaphore(t *testing.T) {
+	var unlimited semaphore
+	assert.Nil(t, unlimited.acquire(context.Background()))
+	unlimited.release()
+	assert.Nil(t, newSemaphore(0))
+
+	s := newSemaphore(1)
+	assert.Nil(t, s.acquire(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.acquire(ctx))
+
+	s.release()
+	assert.Nil(t, s.acquire(context.Background()))
+}
+
+func newTestBulk(client *elastic.Client, docs int) *bulkBody {
+	bulk := newBulkBody(client, "")
+	for i := 0; i < docs; i++ {
+		bulk.add("idx", "doc", "1", map[string]string{"a": "b"})
+	}
+	return bulk
+}
+
+func TestBulkPipeline_Order(t *testing.T) {
+	// The bigger the bulk, the faster the answer
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if lines := bytes.Count(body, []byte("\n")); lines > 0 {
+			time.Sleep(time.Duration(100/lines) * time.Millisecond)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	client, _, err := newElasticClient(srv.URL, ConnectionConfig{}, nil, nil)
+	assert.Nil(t, err)
+
+	var mu sync.Mutex
+	var pushed []int
+	c := &Consumer{
+		Index:       "idx",
+		client:      client,
+		maxInFlight: 3,
+		stats:       &runStats{},
+		logger:      FromLogger(gTestLogger),
+		onPushCallback: func(n int) {
+			mu.Lock()
+			defer mu.Unlock()
+			pushed = append(pushed, n)
+		},
+	}
+
+	p := newBulkPipeline(c)
+	for docs := 1; docs <= 5; docs++ {
+		assert.True(t, p.push(newTestBulk(client, docs), 0))
+	}
+	assert.True(t, p.wait())
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, pushed)
+	assert.Equal(t, uint64(15), c.stats.getIndexed())
+}
+
+func TestBulkPipeline_Failure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_bulk" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	client, _, err := newElasticClient(srv.URL, ConnectionConfig{}, nil, nil)
+	assert.Nil(t, err)
+
+	c := &Consumer{
+		Index:       "idx",
+		client:      client,
+		maxInFlight: 2,
+		stats:       &runStats{},
+		logger:      FromLogger(gTestLogger),
+	}
+
+	p := newBulkPipeline(c)
+	assert.True(t, p.push(newTestBulk(client, 10), 0))
+	assert.False(t, p.wait())
+	assert.False(t, p.push(newTestBulk(client, 10), 0))
+	assert.NotNil(t, c.err)
+	assert.Equal(t, uint64(10), c.stats.getRejected())
+}
+
+func TestBulkPipeline_AckOrder(t *testing.T) {
+	// The first bulk is accepted slowly, the second one fails right away
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/_bulk" && bytes.Count(body, []byte("\n")) > 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"items":[{"index":{"_id":"1","status":201}}]}`))
+	}))
+	defer srv.Close()
+
+	client, _, err := newElasticClient(srv.URL, ConnectionConfig{}, nil, nil)
+	assert.Nil(t, err)
+
+	var mu sync.Mutex
+	var acked []interface{}
+	c := &Consumer{
+		Index:       "idx",
+		client:      client,
+		maxInFlight: 2,
+		stats:       &runStats{},
+		logger:      FromLogger(gTestLogger),
+		onAckCallback: func(tokens []interface{}, results []AckResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			acked = append(acked, tokens...)
+		},
+	}
+
+	p := newBulkPipeline(c)
+	for i, docs := range []int{1, 2} {
+		bulk := newTestBulk(client, docs)
+		bulk.setToken(i)
+		assert.True(t, p.push(bulk, 0))
+	}
+	assert.False(t, p.wait())
+
+	// The failure is passed after the success of the bulk built before
+	assert.Equal(t, []interface{}{0, nil, 1}, acked)
+}
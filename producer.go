@@ -1,6 +1,9 @@
 package elasticwg
 
-import "sync"
+import (
+	"context"
+	"sync"
+)
 
 // ProducerInterface a generic interface which provides documents to be pushed to the consumers
 type ProducerInterface interface {
@@ -9,12 +12,32 @@ type ProducerInterface interface {
 
 // Producer ows the ProducerInterface and publish to the consumer channel
 type Producer struct {
-	c                            chan *Document
-	wg                           *sync.WaitGroup
-	pi                           ProducerInterface
-	counter                      uint64
+	c            chan *Document
+	partitions   []chan *Document
+	mirrors      [][]chan *Document
+	wg           *sync.WaitGroup
+	pi           ProducerInterface
+	counter      uint64
+	index        string
+	ctx          context.Context
+	budget       *memoryBudget
+	encoder      Encoder
+	idStrategy   IDStrategy
+	fingerprints FingerprintStore
+	spool        *spool
+	checkpoints  *checkpointer
+	// sequenced numbers the documents to acknowledge them, seq being the last number
+	sequenced                    bool
+	seq                          uint64
+	onAbort                      func(error)
+	logger                       StructuredLogger
+	metrics                      Metrics
+	stats                        *runStats
+	events                       *runEvents
+	eventSampling                uint64
 	onProduceCallback            func(uint64)
 	onProductionFinishedCallback func(uint64)
+	onAckCallback                func([]interface{}, []AckResult)
 }
 
 func (p *Producer) setChannelAndWaitGroup(ch chan *Document, w *sync.WaitGroup) {
@@ -22,21 +45,201 @@ func (p *Producer) setChannelAndWaitGroup(ch chan *Document, w *sync.WaitGroup)
 	p.wg = w
 }
 
+// partition returns the index of the channel doc is pushed to, 0 if not partitioned
+// In partitioned mode, documents without key are spread evenly since their order doesn't matter
+func (p *Producer) partition(doc *Document) int {
+	if len(p.partitions) == 0 {
+		return 0
+	}
+
+	n := uint32(len(p.partitions))
+	if key := doc.partitionKey(); key != "" {
+		return int(hashKey(key) % n)
+	}
+	return int(uint32(p.counter) % n)
+}
+
+// channel returns the channel doc is pushed to
+func (p *Producer) channel(doc *Document) chan *Document {
+	if len(p.partitions) == 0 {
+		return p.c
+	}
+	return p.partitions[p.partition(doc)]
+}
+
+// Context returns the context of the run, done when the run is canceled or has failed
+// Producers should stop producing once it is done
+func (p *Producer) Context() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
 // Push push Elasticsearch document to the consuming channel & run the onProduceCallback if provided
+// Documents without ID get one from the ID strategy if set, & are rejected if it fails
+// In incremental mode, documents indexed with the same content by a previous run are skipped
+// It blocks while the workgroup memory budget is exhausted. The document is dropped if the run is canceled
+// In partitioned mode, documents with the same partition key are always sent by the same consumer
+// When the workgroup has several targets, the document is pushed to the consumers of each of them
+// With a spool, the document is written to it first, & the run fails if it can't be
 func (p *Producer) Push(doc *Document) {
-	p.c <- doc
+	if doc.ID == "" && p.idStrategy != nil {
+		id, err := p.idStrategy.GenerateID(doc)
+		if err != nil {
+			p.reject(doc, "Unable to generate document ID", err)
+			return
+		}
+		doc.ID = id
+	}
+
+	// Documents whose content didn't change since they were indexed are skipped
+	if p.fingerprints != nil && doc.ID != "" {
+		skip, err := unchanged(p.fingerprints, doc, p.encoder)
+		if err != nil && p.logger != nil {
+			p.logger.Warn("Unable to check the document fingerprint, sending it", F("id", doc.ID), F("error", err))
+		}
+		if skip {
+			p.stats.addSkipped(1)
+			if p.metrics != nil {
+				p.metrics.AddDocuments(p.index, OutcomeSkipped, 1)
+			}
+			p.ack(doc, AckResult{ID: doc.ID, OK: true, Skipped: true})
+			return
+		}
+	}
+
+	if p.budget != nil {
+		doc.size = documentSize(doc, p.encoder)
+	}
+	p.send(doc)
+}
+
+// send hands doc to the consumers & runs the onProduceCallback if provided
+// It returns false if the document has been dropped
+func (p *Producer) send(doc *Document) bool {
+	// Each target consumer releases the document size once sent
+	if p.budget != nil {
+		if p.budget.acquire(p.Context(), doc.size*int64(1+len(p.mirrors))) != nil {
+			return false
+		}
+	}
+
+	// Documents replayed from the spool are already in it & numbered
+	if p.spool != nil && doc.seq == 0 {
+		if err := p.spool.append(doc, p.encoder); err != nil {
+			p.budget.release(doc.size * int64(1+len(p.mirrors)))
+			if p.logger != nil {
+				p.logger.Error("Unable to write the document to the spool", F("id", doc.ID), F("error", err))
+			}
+			if p.onAbort != nil {
+				p.onAbort(err)
+			}
+			return false
+		}
+	}
+	if p.sequenced && doc.seq == 0 {
+		doc.seq = p.seq + 1
+	}
+	if doc.seq > p.seq {
+		p.seq = doc.seq
+	}
+
+	idx := p.partition(doc)
+	select {
+	case p.channel(doc) <- doc:
+	case <-p.Context().Done():
+		return false
+	}
+	for _, channels := range p.mirrors {
+		select {
+		case channels[idx] <- doc:
+		case <-p.Context().Done():
+			return false
+		}
+	}
 	p.counter++
+	p.stats.addProduced(1)
+	if p.metrics != nil {
+		p.metrics.AddDocuments(p.index, OutcomeProduced, 1)
+	}
 	if p.onProduceCallback != nil {
 		p.onProduceCallback(p.counter)
 	}
+	if p.eventSampling > 0 && p.counter%p.eventSampling == 0 && p.events.enabled() {
+		p.events.publish(DocumentProduced{EventMeta: p.events.meta(), Count: p.counter})
+	}
+	return true
+}
+
+// Checkpoint marks the position of the producer after the documents pushed so far with an opaque token
+// The token is saved once these documents are all acknowledged, & passed to Resume by the next run
+// if this one doesn't succeed. It does nothing without a checkpoint store
+func (p *Producer) Checkpoint(token string) {
+	p.checkpoints.add(p.seq, token)
+}
+
+// ack passes the outcome of a document not sent to the acknowledgement callback if defined
+func (p *Producer) ack(doc *Document, result AckResult) {
+	if p.onAckCallback != nil && doc.Ack != nil {
+		p.onAckCallback([]interface{}{doc.Ack}, []AckResult{result})
+	}
+}
+
+// reject accounts for a document which can't be pushed
+func (p *Producer) reject(doc *Document, msg string, err error) {
+	if p.logger != nil {
+		p.logger.Warn(msg, F("error", err))
+	}
+	p.stats.addRejected(1)
+	p.ack(doc, AckResult{ID: doc.ID, Reason: err.Error()})
+	if p.metrics != nil {
+		p.metrics.AddDocuments(p.index, OutcomeRejected, 1)
+	}
+	if p.events.enabled() {
+		p.events.publish(ItemRejected{EventMeta: p.events.meta(), Reason: err.Error()})
+	}
 }
 
 func (p *Producer) produce() {
 	defer p.wg.Done()
+	if p.spool != nil && !p.replay() {
+		return
+	}
 	p.pi.Produce(p)
 
 	// Exec the produce callback a last time at the end
 	if p.onProductionFinishedCallback != nil {
 		p.onProductionFinishedCallback(p.counter)
 	}
+	if p.events.enabled() {
+		p.events.publish(ProductionFinished{EventMeta: p.events.meta(), Count: p.counter})
+	}
+}
+
+// replay sends the documents of the spool left unacknowledged by the previous runs, before the new ones
+// It returns false if the run can't go on
+func (p *Producer) replay() bool {
+	var replayed uint64
+	err := p.spool.replay(func(doc *Document) bool {
+		if !p.send(doc) {
+			return false
+		}
+		replayed++
+		return true
+	})
+	p.stats.addReplayed(replayed)
+	if replayed > 0 && p.logger != nil {
+		p.logger.Info("Documents replayed from the spool", F("documents", replayed))
+	}
+	if err != nil {
+		if p.logger != nil {
+			p.logger.Error("Unable to replay the spool", F("error", err))
+		}
+		if p.onAbort != nil {
+			p.onAbort(err)
+		}
+		return false
+	}
+	return p.Context().Err() == nil
 }
@@ -39,6 +39,40 @@ func TestProducer_Push(t *testing.T) {
 	assert.Equal(t, []string{"test1", "test2"}, resultDoc.Content)
 }
 
+func TestProducer_PushPartitioned(t *testing.T) {
+	p := Producer{}
+	p.partitions = []chan *Document{make(chan *Document, 100), make(chan *Document, 100), make(chan *Document, 100)}
+
+	// Documents of a key always go to the same partition
+	for i := 0; i < 30; i++ {
+		p.Push(&Document{ID: strconv.Itoa(i % 10)})
+		p.Push(&Document{ID: strconv.Itoa(i), PartitionKey: "custom"})
+	}
+	// Documents without key are spread evenly
+	for i := 0; i < 30; i++ {
+		p.Push(&Document{})
+	}
+
+	partitionOf := map[string]int{}
+	for i, c := range p.partitions {
+		close(c)
+		anonymous := 0
+		for doc := range c {
+			key := doc.partitionKey()
+			if key == "" {
+				anonymous++
+				continue
+			}
+			if prev, ok := partitionOf[key]; ok {
+				assert.Equal(t, prev, i, key)
+			}
+			partitionOf[key] = i
+		}
+		assert.Equal(t, 10, anonymous)
+	}
+	assert.Len(t, partitionOf, 11)
+}
+
 func TestProducer_PushWithCallback(t *testing.T) {
 	var finalCount uint64
 	expectedCount := 150
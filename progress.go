@@ -0,0 +1,118 @@
+package elasticwg
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultProgressWindow = 30 * time.Second
+
+// Sizer optional interface a ProducerInterface can implement to report the
+// number of documents it is expected to produce
+type Sizer interface {
+	ExpectedDocuments() uint64
+}
+
+// ProgressSnapshot the progress of a workgroup run at a given time
+// Rate is the indexed documents per second over the progress window.
+// Total, Percent & ETA are only known when the ProducerInterface implements Sizer,
+// otherwise Percent is -1. ETA is 0 while it can't be estimated.
+// Skipped documents count as done in Percent & ETA
+type ProgressSnapshot struct {
+	Time     time.Time
+	Elapsed  time.Duration
+	Produced uint64
+	Indexed  uint64
+	Skipped  uint64
+	Total    uint64
+	Percent  float64
+	Rate     float64
+	ETA      time.Duration
+}
+
+type progressSample struct {
+	t       time.Time
+	indexed uint64
+}
+
+// progressTracker computes progress snapshots from the run stats
+type progressTracker struct {
+	mu      sync.Mutex
+	stats   *runStats
+	total   uint64
+	start   time.Time
+	window  time.Duration
+	samples []progressSample
+}
+
+func newProgressTracker(stats *runStats, total uint64, window time.Duration) *progressTracker {
+	if window <= 0 {
+		window = defaultProgressWindow
+	}
+
+	now := time.Now()
+	return &progressTracker{
+		stats:   stats,
+		total:   total,
+		start:   now,
+		window:  window,
+		samples: []progressSample{{t: now}},
+	}
+}
+
+func (t *progressTracker) snapshot(now time.Time) ProgressSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := ProgressSnapshot{
+		Time:     now,
+		Elapsed:  now.Sub(t.start),
+		Produced: t.stats.getProduced(),
+		Indexed:  t.stats.getIndexed(),
+		Skipped:  t.stats.getSkipped(),
+		Total:    t.total,
+		Percent:  -1,
+	}
+
+	// Keep the newest sample older than the window, so the rate covers the whole window
+	t.samples = append(t.samples, progressSample{t: now, indexed: s.Indexed})
+	windowStart := now.Add(-t.window)
+	for len(t.samples) > 2 && !t.samples[1].t.After(windowStart) {
+		t.samples = t.samples[1:]
+	}
+
+	oldest := t.samples[0]
+	if dt := now.Sub(oldest.t).Seconds(); dt > 0 {
+		s.Rate = float64(s.Indexed-oldest.indexed) / dt
+	}
+
+	if t.total > 0 {
+		done := s.Indexed + s.Skipped
+		s.Percent = 100 * float64(done) / float64(t.total)
+		if s.Percent > 100 {
+			s.Percent = 100
+		}
+
+		if s.Rate > 0 && done < t.total {
+			s.ETA = time.Duration(float64(t.total-done) / s.Rate * float64(time.Second))
+		}
+	}
+
+	return s
+}
+
+// report calls cb with a snapshot every interval, and a last time once cStop is closed
+func (t *progressTracker) report(interval time.Duration, cb func(ProgressSnapshot), cStop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cStop:
+			cb(t.snapshot(time.Now()))
+			return
+		case now := <-ticker.C:
+			cb(t.snapshot(now))
+		}
+	}
+}
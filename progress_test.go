@@ -0,0 +1,77 @@
+package elasticwg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestProgressTracker_snapshotUnknownTotal(t *testing.T) {
+	stats := &runStats{}
+	tracker := newProgressTracker(stats, 0, time.Minute)
+
+	stats.addProduced(150)
+	stats.addIndexed(100)
+	s := tracker.snapshot(tracker.start.Add(10 * time.Second))
+
+	assert.Equal(t, uint64(150), s.Produced)
+	assert.Equal(t, uint64(100), s.Indexed)
+	assert.Equal(t, float64(-1), s.Percent)
+	assert.Equal(t, float64(10), s.Rate)
+	assert.Equal(t, time.Duration(0), s.ETA)
+}
+
+func TestProgressTracker_snapshotETA(t *testing.T) {
+	stats := &runStats{}
+	tracker := newProgressTracker(stats, 1000, 10*time.Second)
+
+	stats.addIndexed(100)
+	tracker.snapshot(tracker.start.Add(10 * time.Second))
+
+	// The rate only covers the last 10 seconds: 300 docs in 10s
+	stats.addIndexed(300)
+	s := tracker.snapshot(tracker.start.Add(20 * time.Second))
+	assert.Equal(t, float64(40), s.Percent)
+	assert.Equal(t, float64(30), s.Rate)
+	assert.Equal(t, 20*time.Second, s.ETA)
+
+	stats.addIndexed(600)
+	s = tracker.snapshot(tracker.start.Add(30 * time.Second))
+	assert.Equal(t, float64(100), s.Percent)
+	assert.Equal(t, time.Duration(0), s.ETA)
+}
+
+func TestProgressTracker_report(t *testing.T) {
+	tracker := newProgressTracker(&runStats{}, 0, 0)
+	assert.Equal(t, defaultProgressWindow, tracker.window)
+
+	snapshots := make(chan ProgressSnapshot, 100)
+	cStop := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(cStop)
+	}()
+	tracker.report(10*time.Millisecond, func(s ProgressSnapshot) {
+		snapshots <- s
+	}, cStop)
+
+	assert.True(t, len(snapshots) >= 2)
+}
+
+type testSizedProducer struct {
+	testProducer
+}
+
+func (p *testSizedProducer) ExpectedDocuments() uint64 {
+	return 250
+}
+
+func TestWorkgroup_SetProgressCallback(t *testing.T) {
+	wg := NewWorkgroup(esURL, testCfg, &testSizedProducer{}, gTestLogger)
+	wg.SetProgressCallback(time.Second, func(s ProgressSnapshot) {
+		gTestLogger.Infof("%d/%d", s.Indexed, s.Total)
+	})
+
+	assert.NotNil(t, wg.onProgressCallback)
+	assert.Equal(t, time.Second, wg.progressInterval)
+}
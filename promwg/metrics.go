@@ -0,0 +1,143 @@
+// Package promwg provides a Prometheus implementation of elasticwg.Metrics
+package promwg
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/thundersnake/elasticwg"
+	"time"
+)
+
+var outcomes = []elasticwg.Outcome{
+	elasticwg.OutcomeProduced,
+	elasticwg.OutcomeIndexed,
+	elasticwg.OutcomeRejected,
+	elasticwg.OutcomeRetried,
+	elasticwg.OutcomeSkipped,
+	elasticwg.OutcomeFailedOver,
+}
+
+// Metrics Prometheus metrics fed by an elasticwg workgroup, labeled by index name
+// Metrics is a prometheus.Collector and must be registered to be exposed
+type Metrics struct {
+	documents       map[elasticwg.Outcome]*prometheus.CounterVec
+	bulks           map[elasticwg.Outcome]*prometheus.CounterVec
+	bulkLatency     *prometheus.HistogramVec
+	bulkBytes       *prometheus.HistogramVec
+	channelDocs     *prometheus.GaugeVec
+	activeConsumers *prometheus.GaugeVec
+	bulkSize        *prometheus.GaugeVec
+	targetConsumers *prometheus.GaugeVec
+}
+
+// NewMetrics creates the workgroup metrics, prefixed by namespace
+func NewMetrics(namespace string) *Metrics {
+	m := &Metrics{
+		documents: make(map[elasticwg.Outcome]*prometheus.CounterVec),
+		bulks:     make(map[elasticwg.Outcome]*prometheus.CounterVec),
+		bulkLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "bulk_latency_seconds",
+			Help:      "Bulk requests latency.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		}, []string{"index"}),
+		bulkBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "bulk_size_bytes",
+			Help:      "Bulk requests body size.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 2, 16),
+		}, []string{"index"}),
+		channelDocs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "channel_documents",
+			Help:      "Documents waiting in the workgroup channel.",
+		}, []string{"index"}),
+		activeConsumers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_consumers",
+			Help:      "Consumers currently running.",
+		}, []string{"index"}),
+		bulkSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "bulk_size_documents",
+			Help:      "Documents per bulk request.",
+		}, []string{"index"}),
+		targetConsumers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "target_consumers",
+			Help:      "Consumers allowed to send bulk requests.",
+		}, []string{"index"}),
+	}
+
+	for _, o := range outcomes {
+		m.documents[o] = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "documents_" + string(o) + "_total",
+			Help:      "Documents " + string(o) + ".",
+		}, []string{"index"})
+		m.bulks[o] = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bulks_" + string(o) + "_total",
+			Help:      "Bulk requests " + string(o) + ".",
+		}, []string{"index"})
+	}
+
+	return m
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	c := []prometheus.Collector{m.bulkLatency, m.bulkBytes, m.channelDocs, m.activeConsumers, m.bulkSize, m.targetConsumers}
+	for _, o := range outcomes {
+		c = append(c, m.documents[o], m.bulks[o])
+	}
+	return c
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// AddDocuments implements elasticwg.Metrics
+func (m *Metrics) AddDocuments(index string, outcome elasticwg.Outcome, n int) {
+	if c, ok := m.documents[outcome]; ok && n > 0 {
+		c.WithLabelValues(index).Add(float64(n))
+	}
+}
+
+// AddBulks implements elasticwg.Metrics
+func (m *Metrics) AddBulks(index string, outcome elasticwg.Outcome, n int) {
+	if c, ok := m.bulks[outcome]; ok && n > 0 {
+		c.WithLabelValues(index).Add(float64(n))
+	}
+}
+
+// ObserveBulk implements elasticwg.Metrics
+func (m *Metrics) ObserveBulk(index string, latency time.Duration, bytes int64) {
+	m.bulkLatency.WithLabelValues(index).Observe(latency.Seconds())
+	m.bulkBytes.WithLabelValues(index).Observe(float64(bytes))
+}
+
+// SetChannelOccupancy implements elasticwg.Metrics
+func (m *Metrics) SetChannelOccupancy(index string, n int) {
+	m.channelDocs.WithLabelValues(index).Set(float64(n))
+}
+
+// AddActiveConsumers implements elasticwg.Metrics
+func (m *Metrics) AddActiveConsumers(index string, delta int) {
+	m.activeConsumers.WithLabelValues(index).Add(float64(delta))
+}
+
+// SetBulkSettings implements elasticwg.Metrics
+func (m *Metrics) SetBulkSettings(index string, bulkSize, consumers int) {
+	m.bulkSize.WithLabelValues(index).Set(float64(bulkSize))
+	m.targetConsumers.WithLabelValues(index).Set(float64(consumers))
+}
@@ -0,0 +1,42 @@
+package promwg
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/thundersnake/elasticwg"
+	"testing"
+	"time"
+)
+
+func TestNewMetricsRegister(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	assert.Nil(t, reg.Register(NewMetrics("elasticwg")))
+}
+
+func TestMetrics_AddDocuments(t *testing.T) {
+	m := NewMetrics("elasticwg")
+	m.AddDocuments("idx", elasticwg.OutcomeIndexed, 500)
+	m.AddDocuments("idx", elasticwg.OutcomeIndexed, 250)
+	m.AddDocuments("idx", elasticwg.OutcomeRejected, 3)
+	m.AddDocuments("idx", elasticwg.Outcome("unknown"), 3)
+
+	assert.Equal(t, float64(750), testutil.ToFloat64(m.documents[elasticwg.OutcomeIndexed].WithLabelValues("idx")))
+	assert.Equal(t, float64(3), testutil.ToFloat64(m.documents[elasticwg.OutcomeRejected].WithLabelValues("idx")))
+}
+
+func TestMetrics_Gauges(t *testing.T) {
+	m := NewMetrics("elasticwg")
+	m.AddActiveConsumers("idx", 1)
+	m.AddActiveConsumers("idx", 1)
+	m.AddActiveConsumers("idx", -1)
+	m.SetChannelOccupancy("idx", 42)
+	m.ObserveBulk("idx", 20*time.Millisecond, 4096)
+	m.SetBulkSettings("idx", 500, 8)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.activeConsumers.WithLabelValues("idx")))
+	assert.Equal(t, float64(42), testutil.ToFloat64(m.channelDocs.WithLabelValues("idx")))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.bulkLatency))
+	assert.Equal(t, float64(500), testutil.ToFloat64(m.bulkSize.WithLabelValues("idx")))
+	assert.Equal(t, float64(8), testutil.ToFloat64(m.targetConsumers.WithLabelValues("idx")))
+}
@@ -0,0 +1,153 @@
+package elasticwg
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxRateLimitDelay bounds a single wait, so a rate change applies to consumers already waiting
+const maxRateLimitDelay = 250 * time.Millisecond
+
+// RateLimit workgroup-wide throughput limits shared by all the consumers
+// A zero value disables the limit. Bursts up to one second of throughput are allowed
+type RateLimit struct {
+	DocumentsPerSecond float64 `yaml:"documents-per-second"`
+	BytesPerSecond     float64 `yaml:"bytes-per-second"`
+}
+
+// tokenBucket a token bucket refilled at rate tokens per second, holding up to rate tokens
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) setRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.rate <= 0 {
+		// Start with a full bucket
+		b.tokens = rate
+	} else {
+		b.refill(now)
+	}
+	b.rate = rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) getRate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// take consumes n tokens, or returns how long to wait before trying again
+// A request larger than the bucket waits for a full bucket & leaves it in debt
+func (b *tokenBucket) take(n float64, now time.Time) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0, true
+	}
+
+	b.refill(now)
+	need := n
+	if need > b.rate {
+		need = b.rate
+	}
+	if b.tokens >= need {
+		b.tokens -= n
+		return 0, true
+	}
+
+	delay := time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+	if delay > maxRateLimitDelay {
+		delay = maxRateLimitDelay
+	}
+	return delay, false
+}
+
+// wait blocks until n tokens are consumed or ctx is done
+func (b *tokenBucket) wait(ctx context.Context, n float64) error {
+	for {
+		delay, ok := b.take(n, time.Now())
+		if ok {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// rateLimiter limits the documents & bytes sent to Elasticsearch per second
+type rateLimiter struct {
+	docs  tokenBucket
+	bytes tokenBucket
+}
+
+func newRateLimiter(l RateLimit) *rateLimiter {
+	r := &rateLimiter{}
+	r.set(l)
+	return r
+}
+
+func (r *rateLimiter) set(l RateLimit) {
+	r.docs.setRate(l.DocumentsPerSecond)
+	r.bytes.setRate(l.BytesPerSecond)
+}
+
+func (r *rateLimiter) get() RateLimit {
+	return RateLimit{
+		DocumentsPerSecond: r.docs.getRate(),
+		BytesPerSecond:     r.bytes.getRate(),
+	}
+}
+
+// wait blocks until a bulk request of docs documents & bytes bytes can be sent
+func (r *rateLimiter) wait(ctx context.Context, docs int, bytes int64) error {
+	if r == nil {
+		return nil
+	}
+
+	if err := r.docs.wait(ctx, float64(docs)); err != nil {
+		return err
+	}
+	return r.bytes.wait(ctx, float64(bytes))
+}
+
+// poll applies the rate limit returned by cb every interval until ctx is done
+func (r *rateLimiter) poll(ctx context.Context, interval time.Duration, cb func() RateLimit) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.set(cb())
+		}
+	}
+}
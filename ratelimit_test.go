@@ -0,0 +1,79 @@
+package elasticwg
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket_Take(t *testing.T) {
+	b := &tokenBucket{}
+	b.setRate(100)
+	now := b.last
+
+	// The bucket starts full
+	_, ok := b.take(100, now)
+	assert.True(t, ok)
+
+	delay, ok := b.take(50, now)
+	assert.False(t, ok)
+	assert.Equal(t, maxRateLimitDelay, delay)
+
+	delay, ok = b.take(10, now)
+	assert.False(t, ok)
+	assert.Equal(t, 100*time.Millisecond, delay)
+
+	_, ok = b.take(10, now.Add(100*time.Millisecond))
+	assert.True(t, ok)
+}
+
+func TestTokenBucket_TakeLargerThanBucket(t *testing.T) {
+	b := &tokenBucket{}
+	b.setRate(100)
+	now := b.last
+
+	// A request larger than the bucket goes through once the bucket is full
+	_, ok := b.take(300, now)
+	assert.True(t, ok)
+
+	// & the bucket pays the debt back
+	_, ok = b.take(1, now.Add(time.Second))
+	assert.False(t, ok)
+	_, ok = b.take(1, now.Add(3*time.Second))
+	assert.True(t, ok)
+}
+
+func TestTokenBucket_Unlimited(t *testing.T) {
+	b := &tokenBucket{}
+	_, ok := b.take(1e9, time.Now())
+	assert.True(t, ok)
+
+	b.setRate(10)
+	assert.Equal(t, float64(10), b.getRate())
+	b.setRate(0)
+	_, ok = b.take(1e9, time.Now())
+	assert.True(t, ok)
+}
+
+func TestRateLimiter_Wait(t *testing.T) {
+	var nilLimiter *rateLimiter
+	assert.Nil(t, nilLimiter.wait(context.Background(), 1000, 1000))
+
+	r := newRateLimiter(RateLimit{DocumentsPerSecond: 1000, BytesPerSecond: 1000})
+	assert.Equal(t, RateLimit{DocumentsPerSecond: 1000, BytesPerSecond: 1000}, r.get())
+
+	tStart := time.Now()
+	assert.Nil(t, r.wait(context.Background(), 1000, 100))
+	assert.Nil(t, r.wait(context.Background(), 100, 100))
+	assert.True(t, time.Since(tStart) >= 50*time.Millisecond)
+
+	// The documents bucket is empty
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, r.wait(ctx, 1000, 0))
+
+	// Rate changes apply to the next requests
+	r.set(RateLimit{})
+	assert.Nil(t, r.wait(ctx, 1000000, 1000000))
+}
@@ -0,0 +1,33 @@
+package elasticwg
+
+import "time"
+
+// RunReport the summary of a workgroup run
+// BulkSize & Consumers are the settings at the end of the run, changed by the adaptive mode
+// MemoryHighWater is the peak of the document bytes held by the run, only measured with a memory budget
+// Generation is the generation the documents are stamped with & Deleted the documents deleted in sync mode
+// FailedOver is the documents indexed by the failover cluster instead of the primary one
+// Replayed is the documents left unacknowledged in the spool by the previous runs & sent again
+// ResumedFrom is the checkpoint the run resumed from & Checkpoint the last one it saved
+// With several targets, the figures are the primary target ones & Targets has a section per target
+type RunReport struct {
+	RunID           string
+	Index           string
+	Start           time.Time
+	End             time.Time
+	Duration        time.Duration
+	Produced        uint64
+	Indexed         uint64
+	Rejected        uint64
+	Skipped         uint64
+	FailedOver      uint64
+	Replayed        uint64
+	ResumedFrom     string
+	Checkpoint      string
+	Generation      int64
+	Deleted         int64
+	BulkSize        int
+	Consumers       int
+	MemoryHighWater int64
+	Targets         []TargetReport
+}
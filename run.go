@@ -0,0 +1,474 @@
+package elasticwg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RunHandle controls a workgroup run started with Start
+type RunHandle struct {
+	r *run
+}
+
+// Wait blocks until the run is finished & returns its report
+// The error is nil if the run succeeded, context.Canceled if it was canceled
+func (h *RunHandle) Wait() (RunReport, error) {
+	<-h.r.cDone
+	return h.r.report, h.r.err
+}
+
+// Done returns a channel closed when the run is finished
+func (h *RunHandle) Done() <-chan struct{} {
+	return h.r.cDone
+}
+
+// Progress returns a snapshot of the run progress
+func (h *RunHandle) Progress() ProgressSnapshot {
+	return h.r.progress.snapshot(time.Now())
+}
+
+// Pause stops dispatching documents to the consumers until Resume is called
+// Documents already produced are kept in the workgroup channel & consumers bulks
+func (h *RunHandle) Pause() {
+	h.r.gate.pause(pauseReasonManual)
+}
+
+// Resume restarts dispatching documents to the consumers after Pause
+func (h *RunHandle) Resume() {
+	h.r.gate.resume(pauseReasonManual)
+}
+
+// SetRateLimit changes the documents & bytes sent per second by the consumers
+func (h *RunHandle) SetRateLimit(l RateLimit) {
+	h.r.limiter.set(l)
+}
+
+// Cancel stops the run, documents not yet pushed to Elasticsearch are dropped
+func (h *RunHandle) Cancel() {
+	h.r.fail(context.Canceled)
+}
+
+// run the state of a workgroup run
+type run struct {
+	id       string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	log      StructuredLogger
+	events   *runEvents
+	stats    *runStats
+	progress *progressTracker
+	gate     *pauseGate
+	limiter  *rateLimiter
+	budget   *memoryBudget
+	spool    *spool
+	// acks follows the acknowledgement of the documents for the spool & the checkpoints
+	acks        *ackTracker
+	checkpoints *checkpointer
+	resumedFrom string
+	targets     []*target
+	start       time.Time
+	// generation the documents are stamped with in sync mode
+	generation int64
+	mu         sync.Mutex
+	err        error
+	report     RunReport
+	cDone      chan struct{}
+}
+
+// fail records the first error making the run fail & cancels it
+func (r *run) fail(err error) {
+	r.mu.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.mu.Unlock()
+	r.cancel()
+}
+
+// commit records that the documents up to committed are all acknowledged
+func (r *run) commit(committed uint64) {
+	if r.spool != nil {
+		r.spool.commit(committed)
+	}
+	r.checkpoints.commit(committed)
+}
+
+// failure returns the error making the run fail, if any
+// The parent context cancellation counts as a failure
+func (r *run) failure() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.ctx.Err()
+	}
+	return r.err
+}
+
+// newRunID returns a random identifier attached to the logs of a run
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Start make the workgroup run in background & returns the handle controlling it
+// Canceling ctx cancels the run. A workgroup can only run once at a time
+func (w *Workgroup) Start(ctx context.Context) *RunHandle {
+	r := &run{
+		id:      newRunID(),
+		stats:   &runStats{},
+		gate:    newPauseGate(),
+		limiter: w.limiter,
+		budget:  newMemoryBudget(w.cfg.MemoryBudget),
+		start:   time.Now(),
+		cDone:   make(chan struct{}),
+	}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	if w.cfg.Sync.Enabled {
+		r.generation = r.start.UnixNano() / int64(time.Millisecond)
+	}
+	r.log = w.log.With(F("index", w.cfg.IndexName), F("run_id", r.id))
+	r.events = &runEvents{bus: w.events, runID: r.id, index: w.cfg.IndexName}
+
+	var total uint64
+	if sizer, ok := w.p.pi.(Sizer); ok {
+		total = sizer.ExpectedDocuments()
+	}
+	r.progress = newProgressTracker(r.stats, total, w.cfg.ProgressWindow)
+
+	go w.execute(r)
+	return &RunHandle{r: r}
+}
+
+// execute runs the workgroup phases
+func (w *Workgroup) execute(r *run) {
+	defer close(r.cDone)
+	defer r.cancel()
+
+	log := r.log
+	ev := r.events
+
+	ctx, span := w.tracer.Start(r.ctx, "elasticwg.Run",
+		Attribute{Key: "elasticwg.index", Value: w.cfg.IndexName},
+		Attribute{Key: "elasticwg.run_id", Value: r.id},
+	)
+	defer span.End()
+
+	if w.onStartupCallback != nil {
+		// If startup callback has failed, stop immediately
+		if !w.onStartupCallback() {
+			w.failRun(r, span, errors.New("startup callback failed"))
+			return
+		}
+	}
+
+	// Skipped documents wouldn't be stamped & would be deleted
+	if w.cfg.Sync.Enabled && w.fingerprints != nil {
+		w.failRun(r, span, errors.New("sync mode is incompatible with the incremental mode"))
+		return
+	}
+
+	// Fingerprints are recorded from the primary target only
+	if w.fingerprints != nil && len(w.cfg.Targets) > 0 {
+		w.failRun(r, span, errors.New("incremental mode is incompatible with several targets"))
+		return
+	}
+
+	// Documents would be acknowledged by the first target done with them
+	if (w.cfg.Spool.Dir != "" || w.checkpoints != nil) && len(w.cfg.Targets) > 0 {
+		w.failRun(r, span, errors.New("spool & checkpoints are incompatible with several targets"))
+		return
+	}
+
+	// An interrupted run is resumed from its last checkpoint
+	var resumer Resumer
+	if w.checkpoints != nil {
+		token, err := w.checkpoints.Load()
+		if err != nil {
+			log.Error("Unable to load the checkpoint", F("error", err))
+			w.failRun(r, span, err)
+			return
+		}
+		if token != "" {
+			var ok bool
+			if resumer, ok = w.p.pi.(Resumer); !ok {
+				w.failRun(r, span, errors.New("producer can't resume from the checkpoint"))
+				return
+			}
+			r.resumedFrom = token
+		}
+	}
+
+	ev.publish(RunStarted{EventMeta: ev.meta()})
+
+	// Each target has its own client, index setup & consumers, the client is shared by the setup phase
+	// & the consumers of the target
+	r.targets = w.newTargets(ctx, r)
+	defer func() {
+		for _, t := range r.targets {
+			t.cancel()
+		}
+	}()
+	for i, t := range r.targets {
+		if err := w.setupTarget(ctx, r, t, i == 0); err != nil {
+			if !t.optional {
+				w.failRun(r, span, err)
+				return
+			}
+			t.fail(err)
+		}
+	}
+
+	// Bulks the primary cluster keeps refusing are redirected to the failover cluster or spool
+	if w.cfg.Failover.enabled() {
+		fo, err := w.setupFailover(ctx, r.targets[0])
+		if err != nil {
+			w.failRun(r, span, err)
+			return
+		}
+		if fo.spool != nil {
+			defer fo.spool.close()
+		}
+		r.targets[0].failover = fo
+	}
+
+	if w.cfg.Spool.Dir != "" {
+		sp, err := openSpool(w.cfg.Spool, log)
+		if err != nil {
+			log.Error("Unable to open the spool", F("error", err))
+			w.failRun(r, span, err)
+			return
+		}
+		defer sp.close()
+		r.spool = sp
+		if sp.pending > 0 {
+			log.Info("Spool has unacknowledged documents, replaying them", F("documents", sp.pending))
+		}
+	}
+
+	// Documents are numbered & acknowledged once their bulk is done, to commit the spool & the checkpoints
+	if r.spool != nil || w.checkpoints != nil {
+		var committed uint64
+		if r.spool != nil {
+			committed = r.spool.committed
+		}
+		if w.checkpoints != nil {
+			r.checkpoints = &checkpointer{store: w.checkpoints, log: log, events: ev, committed: committed}
+		}
+		r.acks = newAckTracker(committed, r.commit)
+	}
+
+	if resumer != nil {
+		log.Info("Resuming from the checkpoint", F("checkpoint", r.resumedFrom))
+		if err := resumer.Resume(r.resumedFrom); err != nil {
+			log.Error("Unable to resume from the checkpoint", F("error", err))
+			w.failRun(r, span, err)
+			return
+		}
+	}
+
+	// A full load sends all the documents again, done before starting the progress reporter
+	if w.fingerprints != nil && w.cfg.ForceFull {
+		if err := w.fingerprints.Reset(); err != nil {
+			log.Error("Unable to reset the fingerprint store", F("error", err))
+			w.failRun(r, span, err)
+			return
+		}
+	}
+
+	cStopProgress := make(chan struct{})
+	if w.onProgressCallback != nil && w.progressInterval > 0 {
+		go r.progress.report(w.progressInterval, w.onProgressCallback, cStopProgress)
+	}
+
+	if w.onRateLimitCallback != nil && w.rateLimitInterval > 0 {
+		go r.limiter.poll(ctx, w.rateLimitInterval, w.onRateLimitCallback)
+	}
+
+	// Create the production wait group
+	wgProduce := &sync.WaitGroup{}
+
+	// Configure & start the producer, documents are pushed to the channels of each target
+	primary := r.targets[0]
+	wgProduce.Add(1)
+	w.p.setChannelAndWaitGroup(primary.channels[0], wgProduce)
+	w.p.partitions = nil
+	if w.cfg.Partitioned {
+		w.p.partitions = primary.channels
+	}
+	w.p.mirrors = nil
+	for _, t := range r.targets[1:] {
+		w.p.mirrors = append(w.p.mirrors, t.channels)
+	}
+	w.p.ctx = ctx
+	w.p.spool = r.spool
+	w.p.checkpoints = r.checkpoints
+	w.p.sequenced = r.acks != nil
+	w.p.seq = 0
+	w.p.onAbort = r.fail
+	w.p.logger = log
+	w.p.budget = r.budget
+	w.p.stats = r.stats
+	w.p.events = ev
+	w.p.eventSampling = uint64(w.cfg.DocumentEventSampling)
+	if w.p.eventSampling == 0 {
+		w.p.eventSampling = defaultDocumentEventSampling
+	}
+	go w.p.produce()
+
+	// Sample the channel occupancy until production is finished
+	cStopSampling := make(chan struct{})
+	go w.sampleChannelOccupancy(r.targets, cStopSampling)
+
+	// Start consuming, a failed optional target drops its documents instead
+	for i, t := range r.targets {
+		if t.failure() == nil {
+			w.startConsumers(r, t, i == 0)
+		}
+	}
+
+	wgProduce.Wait()
+	// Production finished, closing the channels
+	for _, t := range r.targets {
+		t.adaptive.release()
+		for _, cDoc := range t.channels {
+			close(cDoc)
+		}
+	}
+	close(cStopSampling)
+
+	// Now finishing to consume
+	for _, t := range r.targets {
+		t.wg.Wait()
+	}
+	close(cStopProgress)
+
+	// A consumer aborted or the run has been canceled
+	if err := r.failure(); err != nil {
+		log.Error("Run aborted", F("error", err))
+		w.failRun(r, span, err)
+		return
+	}
+
+	for _, t := range r.targets {
+		if t.failure() != nil {
+			continue
+		}
+		if err := w.finishTarget(ctx, r, t); err != nil {
+			if !t.optional {
+				w.failRun(r, span, err)
+				return
+			}
+			t.fail(err)
+		}
+	}
+
+	// The next run starts over, unless documents failed for a transient reason & must be sent again
+	if w.checkpoints != nil && r.acks.getCommitted() < w.p.seq {
+		log.Warn("Documents not accepted by Elasticsearch, keeping the checkpoint",
+			F("documents", w.p.seq-r.acks.getCommitted()), F("checkpoint", r.checkpoints.getSaved()))
+	} else if w.checkpoints != nil {
+		if err := w.checkpoints.Save(""); err != nil {
+			log.Warn("Unable to clear the checkpoint", F("error", err))
+		}
+	}
+
+	if w.onFinishCallback != nil {
+		w.onFinishCallback()
+	}
+
+	r.report = w.buildReport(r)
+	ev.publish(RunFinished{EventMeta: ev.meta(), Report: r.report})
+
+	log.Info("Documents indexed", F("documents", r.report.Indexed), F("elapsed", r.report.Duration.String()),
+		F("bulk_size", r.report.BulkSize))
+}
+
+// buildReport summarizes the run
+func (w *Workgroup) buildReport(r *run) RunReport {
+	end := time.Now()
+	report := RunReport{
+		RunID:           r.id,
+		Index:           w.cfg.IndexName,
+		Start:           r.start,
+		End:             end,
+		Duration:        end.Sub(r.start),
+		Produced:        r.stats.getProduced(),
+		Indexed:         r.stats.getIndexed(),
+		Rejected:        r.stats.getRejected(),
+		Skipped:         r.stats.getSkipped(),
+		FailedOver:      r.stats.getFailedOver(),
+		Replayed:        r.stats.getReplayed(),
+		ResumedFrom:     r.resumedFrom,
+		Checkpoint:      r.checkpoints.getSaved(),
+		Generation:      r.generation,
+		MemoryHighWater: r.budget.getPeak(),
+	}
+	report.BulkSize, report.Consumers = w.cfg.BulkSize, w.cfg.NumConsumers
+
+	// The run figures are the primary target ones, the other targets have their own section
+	for i, t := range r.targets {
+		tr := t.report(w.cfg)
+		if i == 0 {
+			report.Deleted, report.BulkSize, report.Consumers = tr.Deleted, tr.BulkSize, tr.Consumers
+		}
+		if len(r.targets) > 1 {
+			report.Targets = append(report.Targets, tr)
+		}
+	}
+	return report
+}
+
+// failRun records the run failure & notifies the failure callback & the subscribers
+func (w *Workgroup) failRun(r *run, span Span, err error) {
+	r.fail(err)
+	r.report = w.buildReport(r)
+	span.RecordError(r.err)
+	if w.onFailureCallback != nil {
+		w.onFailureCallback()
+	}
+	r.events.publish(RunFailed{EventMeta: r.events.meta(), Err: r.err})
+}
+
+// traceStep runs step inside a span named name, child of the span carried by ctx
+func (w *Workgroup) traceStep(ctx context.Context, name string, step func(context.Context) error) error {
+	ctx, span := w.tracer.Start(ctx, name, Attribute{Key: "elasticwg.index", Value: w.cfg.IndexName})
+	defer span.End()
+
+	err := step(ctx)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return err
+}
+
+// sampleChannelOccupancy reports the documents channels occupancy of each target every second until cStop is closed
+func (w *Workgroup) sampleChannelOccupancy(targets []*target, cStop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cStop:
+			for _, t := range targets {
+				t.metrics.SetChannelOccupancy(w.cfg.IndexName, 0)
+			}
+			return
+		case <-ticker.C:
+			for _, t := range targets {
+				occupancy := 0
+				for _, cDoc := range t.channels {
+					occupancy += len(cDoc)
+				}
+				t.metrics.SetChannelOccupancy(w.cfg.IndexName, occupancy)
+			}
+		}
+	}
+}
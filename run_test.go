@@ -0,0 +1,268 @@
+package elasticwg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// endlessProducer pushes documents until the run is canceled
+type endlessProducer struct {
+}
+
+func (p *endlessProducer) Produce(pe *Producer) {
+	for pe.Context().Err() == nil {
+		pe.Push(&Document{ID: "1", Content: map[string]string{"field": "value"}})
+	}
+}
+
+func newTestElasticServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+}
+
+func TestWorkgroup_StartStartupFailure(t *testing.T) {
+	wg := NewWorkgroup(esURL, testCfg, &testProducer{}, gTestLogger)
+	wg.SetStartupCallback(func() bool {
+		return false
+	})
+
+	failed := false
+	wg.SetFailureCallback(func() {
+		failed = true
+	})
+
+	report, err := wg.Start(context.Background()).Wait()
+	assert.NotNil(t, err)
+	assert.True(t, failed)
+	assert.NotEmpty(t, report.RunID)
+	assert.False(t, wg.Run())
+}
+
+func TestWorkgroup_StartPauseCancel(t *testing.T) {
+	srv := newTestElasticServer()
+	defer srv.Close()
+
+	wg := NewWorkgroup(srv.URL, testCfg, &endlessProducer{}, gTestLogger)
+	h := wg.Start(context.Background())
+
+	h.Pause()
+	assert.True(t, h.r.gate.paused())
+	h.Resume()
+	assert.False(t, h.r.gate.paused())
+
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, h.Progress().Produced > 0)
+
+	h.Cancel()
+	select {
+	case <-h.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("run not finished after cancel")
+	}
+
+	_, err := h.Wait()
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestWorkgroup_StartParentContextCanceled(t *testing.T) {
+	srv := newTestElasticServer()
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	wg := NewWorkgroup(srv.URL, testCfg, &endlessProducer{}, gTestLogger)
+	_, err := wg.Start(ctx).Wait()
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+// countProducer pushes count documents
+type countProducer struct {
+	count int
+}
+
+func (p *countProducer) Produce(pe *Producer) {
+	for i := 0; i < p.count; i++ {
+		pe.Push(&Document{ID: "1", Content: map[string]string{"field": "value"}})
+	}
+}
+
+func TestWorkgroup_StartAdaptive(t *testing.T) {
+	srv := newTestElasticServer()
+	defer srv.Close()
+
+	cfg := testCfg
+	cfg.NumConsumers = 2
+	cfg.BulkSize = 100
+	cfg.Adaptive.Enabled = true
+
+	wg := NewWorkgroup(srv.URL, cfg, &countProducer{count: 5000}, gTestLogger)
+	report, err := wg.Start(context.Background()).Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5000), report.Indexed)
+	// Latencies of the test server are too noisy to predict the adjustments
+	assert.True(t, report.BulkSize >= 10 && report.BulkSize <= 1000)
+	assert.True(t, report.Consumers >= 1 && report.Consumers <= 4)
+}
+
+func TestWorkgroup_StartPipelined(t *testing.T) {
+	srv := newTestElasticServer()
+	defer srv.Close()
+
+	cfg := testCfg
+	cfg.NumConsumers = 2
+	cfg.BulkSize = 100
+	cfg.MaxInFlightPerConsumer = 4
+	cfg.MaxInFlight = 3
+
+	wg := NewWorkgroup(srv.URL, cfg, &countProducer{count: 5000}, gTestLogger)
+	var pushed int64
+	wg.SetOnPushCallback(func(n int) {
+		atomic.AddInt64(&pushed, int64(n))
+	})
+
+	report, err := wg.Start(context.Background()).Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5000), report.Indexed)
+	assert.Equal(t, int64(5000), atomic.LoadInt64(&pushed))
+}
+
+func TestWorkgroup_StartMemoryBudget(t *testing.T) {
+	srv := newTestElasticServer()
+	defer srv.Close()
+
+	// Each document takes 18 bytes, much less than a bulk
+	cfg := testCfg
+	cfg.NumConsumers = 4
+	cfg.BulkSize = 1000
+	cfg.ChannelBufferSize = 1000
+	cfg.MaxInFlightPerConsumer = 2
+	cfg.MemoryBudget = 18 * 300
+
+	wg := NewWorkgroup(srv.URL, cfg, &countProducer{count: 5000}, gTestLogger)
+	report, err := wg.Start(context.Background()).Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5000), report.Indexed)
+	assert.True(t, report.MemoryHighWater > 0)
+	assert.True(t, report.MemoryHighWater <= cfg.MemoryBudget)
+}
+
+func TestWorkgroup_StartEncoder(t *testing.T) {
+	srv := newTestElasticServer()
+	defer srv.Close()
+
+	// Documents the encoder doesn't support are rejected
+	wg := NewWorkgroup(srv.URL, testCfg, &countProducer{count: 1000}, gTestLogger)
+	wg.SetEncoder(generatedEncoder{})
+
+	report, err := wg.Start(context.Background()).Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), report.Indexed)
+	assert.Equal(t, uint64(1000), report.Rejected)
+}
+
+func TestWorkgroup_StartCompression(t *testing.T) {
+	var bulks, docs, plain int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_bulk" {
+			atomic.AddInt32(&bulks, 1)
+			if r.Header.Get("Content-Encoding") != CompressionGzip {
+				atomic.AddInt32(&plain, 1)
+			} else if zr, err := gzip.NewReader(r.Body); err == nil {
+				body, _ := ioutil.ReadAll(zr)
+				atomic.AddInt32(&docs, int32(bytes.Count(body, []byte("\n"))/2))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	// Bulks are flushed by size, far before reaching BulkSize
+	cfg := testCfg
+	cfg.NumConsumers = 1
+	cfg.BulkBytes = 1000
+	cfg.Compression = CompressionGzip
+
+	wg := NewWorkgroup(srv.URL, cfg, &countProducer{count: 1000}, gTestLogger)
+	_, err := wg.Start(context.Background()).Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&plain))
+	assert.Equal(t, int32(1000), atomic.LoadInt32(&docs))
+	assert.True(t, atomic.LoadInt32(&bulks) >= 50)
+}
+
+// versionProducer pushes versions of keys documents, in order
+type versionProducer struct {
+	keys     int
+	versions int
+}
+
+func (p *versionProducer) Produce(pe *Producer) {
+	for v := 0; v < p.versions; v++ {
+		for k := 0; k < p.keys; k++ {
+			pe.Push(&Document{ID: strconv.Itoa(k), Content: map[string]int{"version": v}})
+		}
+	}
+}
+
+func TestWorkgroup_StartPartitioned(t *testing.T) {
+	// Records the versions of each document in the order they are received
+	var mu sync.Mutex
+	versions := map[string][]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_bulk" {
+			body, _ := ioutil.ReadAll(r.Body)
+			lines := bytes.Split(bytes.TrimSpace(body), []byte("\n"))
+			// Uneven latencies, so bulks sent concurrently are applied in any order
+			time.Sleep(time.Duration(len(body)%7) * time.Millisecond)
+			mu.Lock()
+			for i := 0; i+1 < len(lines); i += 2 {
+				var action map[string]struct {
+					ID string `json:"_id"`
+				}
+				var doc struct {
+					Version int `json:"version"`
+				}
+				json.Unmarshal(lines[i], &action)
+				json.Unmarshal(lines[i+1], &doc)
+				id := action["index"].ID
+				versions[id] = append(versions[id], doc.Version)
+			}
+			mu.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	// Many small bulks, so the versions of a document are spread across bulks
+	cfg := testCfg
+	cfg.NumConsumers = 4
+	cfg.BulkBytes = 500
+	cfg.Partitioned = true
+
+	wg := NewWorkgroup(srv.URL, cfg, &versionProducer{keys: 50, versions: 20}, gTestLogger)
+	_, err := wg.Start(context.Background()).Wait()
+	assert.Nil(t, err)
+
+	assert.Len(t, versions, 50)
+	for id, v := range versions {
+		assert.Len(t, v, 20, id)
+		assert.True(t, sort.IntsAreSorted(v), id)
+	}
+}
@@ -0,0 +1,57 @@
+// Package slogwg adapts a log/slog logger to elasticwg.StructuredLogger
+package slogwg
+
+import (
+	"context"
+	"gitlab.com/thundersnake/elasticwg"
+	"log/slog"
+)
+
+type logger struct {
+	logger *slog.Logger
+}
+
+// New wraps l into an elasticwg.StructuredLogger, slog.Default() is used if l is nil
+func New(l *slog.Logger) elasticwg.StructuredLogger {
+	if l == nil {
+		l = slog.Default()
+	}
+
+	return &logger{logger: l}
+}
+
+func attrs(fields []elasticwg.Field) []slog.Attr {
+	a := make([]slog.Attr, len(fields))
+	for i, f := range fields {
+		a[i] = slog.Any(f.Key, f.Value)
+	}
+	return a
+}
+
+func (l *logger) log(level slog.Level, msg string, fields []elasticwg.Field) {
+	l.logger.LogAttrs(context.Background(), level, msg, attrs(fields)...)
+}
+
+func (l *logger) Debug(msg string, fields ...elasticwg.Field) {
+	l.log(slog.LevelDebug, msg, fields)
+}
+
+func (l *logger) Info(msg string, fields ...elasticwg.Field) {
+	l.log(slog.LevelInfo, msg, fields)
+}
+
+func (l *logger) Warn(msg string, fields ...elasticwg.Field) {
+	l.log(slog.LevelWarn, msg, fields)
+}
+
+func (l *logger) Error(msg string, fields ...elasticwg.Field) {
+	l.log(slog.LevelError, msg, fields)
+}
+
+func (l *logger) With(fields ...elasticwg.Field) elasticwg.StructuredLogger {
+	args := make([]interface{}, len(fields))
+	for i, a := range attrs(fields) {
+		args[i] = a
+	}
+	return &logger{logger: l.logger.With(args...)}
+}
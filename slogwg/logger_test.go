@@ -0,0 +1,23 @@
+package slogwg
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/thundersnake/elasticwg"
+	"log/slog"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	l.With(elasticwg.F("index", "idx")).Warn("Failed to perform a bulk query", elasticwg.F("attempt", 2))
+	assert.Contains(t, buf.String(), "level=WARN")
+	assert.Contains(t, buf.String(), `msg="Failed to perform a bulk query"`)
+	assert.Contains(t, buf.String(), "index=idx attempt=2")
+
+	buf.Reset()
+	l.Debug("hidden")
+	assert.Empty(t, buf.String())
+}
@@ -0,0 +1,363 @@
+package elasticwg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultSpoolSegmentBytes = 64 << 20
+	spoolSegmentExt          = ".seg"
+	spoolCommittedFile       = "committed"
+	// spoolHeaderSize the length & the CRC-32 of an entry
+	spoolHeaderSize = 8
+)
+
+// SpoolConfig durable spool configuration: documents pushed are appended to segment files in Dir before being
+// handed to the consumers, & acknowledged once Elasticsearch indexed them or rejected them for good
+// Documents not acknowledged when the process stopped, or failed for a transient reason such as a full write
+// queue, are sent again by the next run, before the producer ones.
+// Segments are rotated at SegmentBytes (64MiB if not set) & deleted once all their documents are acknowledged.
+// Fsync syncs each document to the disk, so they survive a host failure & not only a process crash.
+// It is incompatible with several targets
+type SpoolConfig struct {
+	Dir          string `yaml:"dir"`
+	SegmentBytes int64  `yaml:"segment-bytes"`
+	Fsync        bool   `yaml:"fsync"`
+}
+
+// spoolEntry a document written to the spool
+type spoolEntry struct {
+	Seq          uint64          `json:"seq"`
+	ID           string          `json:"id,omitempty"`
+	PartitionKey string          `json:"key,omitempty"`
+	Source       json.RawMessage `json:"source"`
+	Fingerprint  []byte          `json:"fp,omitempty"`
+}
+
+// spool the append-only segment files documents are written to
+// A segment is named after the sequence number of its first document, the committed file holds the
+// sequence number up to which all the documents are acknowledged
+type spool struct {
+	cfg SpoolConfig
+	log StructuredLogger
+	// committed the sequence up to which the documents were acknowledged when the spool was opened,
+	// & pending the documents left unacknowledged by the previous runs, replayed first
+	committed uint64
+	pending   uint64
+
+	mu       sync.Mutex
+	seq      uint64
+	segments []uint64
+	file     *os.File
+	fileSize int64
+	header   [spoolHeaderSize]byte
+}
+
+// openSpool opens the spool of cfg, creating it if needed
+// A document partially written when the process stopped is truncated
+func openSpool(cfg SpoolConfig, log StructuredLogger) (*spool, error) {
+	if cfg.SegmentBytes <= 0 {
+		cfg.SegmentBytes = defaultSpoolSegmentBytes
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &spool{cfg: cfg, log: log}
+	committed, err := s.readCommitted()
+	if err != nil {
+		return nil, err
+	}
+	s.committed = committed
+	if s.segments, err = s.listSegments(); err != nil {
+		return nil, err
+	}
+
+	s.seq = committed
+	if n := len(s.segments); n > 0 {
+		last := s.segments[n-1]
+		if last > s.seq+1 {
+			s.seq = last - 1
+		}
+		size, err := s.scanSegment(last, func(e *spoolEntry) bool {
+			s.seq = e.Seq
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if s.file, err = os.OpenFile(s.segmentPath(last), os.O_WRONLY, 0644); err != nil {
+			return nil, err
+		}
+		// Drop a document partially written
+		if err := s.file.Truncate(size); err != nil {
+			s.file.Close()
+			return nil, err
+		}
+		if _, err := s.file.Seek(size, io.SeekStart); err != nil {
+			s.file.Close()
+			return nil, err
+		}
+		s.fileSize = size
+	}
+	if s.seq > committed {
+		s.pending = s.seq - committed
+	}
+	return s, nil
+}
+
+func (s *spool) segmentPath(first uint64) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("%020d%s", first, spoolSegmentExt))
+}
+
+// readCommitted returns the committed sequence, 0 for a new spool
+func (s *spool) readCommitted() (uint64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.cfg.Dir, spoolCommittedFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// listSegments returns the first sequence of the segments, in order
+func (s *spool) listSegments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, first)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// scanSegment calls fn for each document of the segment starting at first, until it returns false
+// It returns the size of the valid documents, a document partially written ending the segment
+func (s *spool) scanSegment(first uint64, fn func(e *spoolEntry) bool) (int64, error) {
+	f, err := os.Open(s.segmentPath(first))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var header [spoolHeaderSize]byte
+	var size int64
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return size, nil
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[:4]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return size, nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return size, nil
+		}
+
+		e := &spoolEntry{}
+		if err := json.Unmarshal(payload, e); err != nil {
+			return size, fmt.Errorf("corrupted spool segment %s: %v", s.segmentPath(first), err)
+		}
+		size += int64(spoolHeaderSize + len(payload))
+		if !fn(e) {
+			return size, nil
+		}
+	}
+}
+
+// append writes doc to the spool & numbers it
+func (s *spool) append(doc *Document, enc Encoder) error {
+	source, err := doc.encodedContent(enc)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil || s.fileSize >= s.cfg.SegmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	e := spoolEntry{Seq: s.seq + 1, ID: doc.ID, PartitionKey: doc.PartitionKey, Source: source,
+		Fingerprint: doc.fingerprint}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(s.header[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(s.header[4:], crc32.ChecksumIEEE(payload))
+	if _, err := s.file.Write(append(s.header[:], payload...)); err != nil {
+		return err
+	}
+	if s.cfg.Fsync {
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	s.fileSize += int64(spoolHeaderSize + len(payload))
+	s.seq++
+	doc.seq = s.seq
+	return nil
+}
+
+// rotate starts a new segment for the next document
+func (s *spool) rotate() error {
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			return err
+		}
+		s.file = nil
+	}
+
+	first := s.seq + 1
+	f, err := os.OpenFile(s.segmentPath(first), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.fileSize = 0
+	s.segments = append(s.segments, first)
+	return nil
+}
+
+// replay calls fn for each document left unacknowledged by the previous runs, until it returns false
+func (s *spool) replay(fn func(doc *Document) bool) error {
+	if s.pending == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	committed := s.committed
+	last := committed + s.pending
+	var segments []uint64
+	for i, first := range s.segments {
+		if first > last {
+			break
+		}
+		// Segments whose documents are all committed are skipped
+		if i+1 < len(s.segments) && s.segments[i+1] <= committed+1 {
+			continue
+		}
+		segments = append(segments, first)
+	}
+	s.mu.Unlock()
+
+	for _, first := range segments {
+		stopped := false
+		if _, err := s.scanSegment(first, func(e *spoolEntry) bool {
+			if e.Seq <= committed {
+				return true
+			}
+			if e.Seq > last {
+				return false
+			}
+			doc := &Document{ID: e.ID, PartitionKey: e.PartitionKey, RawContent: e.Source,
+				fingerprint: e.Fingerprint, seq: e.Seq}
+			doc.size = documentSize(doc, nil)
+			stopped = !fn(doc)
+			return !stopped
+		}); err != nil {
+			return err
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// commit records the committed sequence & deletes the segments whose documents are all acknowledged
+// The segment written to is kept
+func (s *spool) commit(committed uint64) {
+	path := filepath.Join(s.cfg.Dir, spoolCommittedFile)
+	if err := writeFileAtomic(path, []byte(strconv.FormatUint(committed, 10))); err != nil {
+		s.log.Error("Unable to record the spool committed offset", F("error", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.segments) > 1 && s.segments[1] <= committed+1 {
+		if err := os.Remove(s.segmentPath(s.segments[0])); err != nil && !os.IsNotExist(err) {
+			s.log.Warn("Unable to delete a spool segment", F("error", err))
+			return
+		}
+		s.segments = s.segments[1:]
+	}
+}
+
+// close closes the segment written to
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// writeFileAtomic writes data to path through a temporary file, so path is never partially written
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// validate checks the spool configuration
+func (sc SpoolConfig) validate() error {
+	if sc.Dir == "" && (sc.SegmentBytes != 0 || sc.Fsync) {
+		return errors.New("spool needs a directory")
+	}
+	if sc.SegmentBytes < 0 {
+		return errors.New("spool segment bytes must be >= 0")
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package elasticwg
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func newTestSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "elasticwg-spool")
+	assert.Nil(t, err)
+	return dir
+}
+
+// spoolDocs returns the documents left unacknowledged in the spool
+func spoolDocs(t *testing.T, s *spool) []*Document {
+	var docs []*Document
+	assert.Nil(t, s.replay(func(doc *Document) bool {
+		docs = append(docs, doc)
+		return true
+	}))
+	return docs
+}
+
+func TestSpool(t *testing.T) {
+	dir := newTestSpoolDir(t)
+	defer os.RemoveAll(dir)
+	cfg := SpoolConfig{Dir: dir, SegmentBytes: 200}
+
+	s, err := openSpool(cfg, FromLogger(gTestLogger))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), s.pending)
+	for i := 0; i < 10; i++ {
+		doc := &Document{ID: strconv.Itoa(i), PartitionKey: "k", Content: map[string]int{"n": i}}
+		assert.Nil(t, s.append(doc, nil))
+		assert.Equal(t, uint64(i+1), doc.seq)
+	}
+	assert.True(t, len(s.segments) > 2)
+
+	// Acknowledged segments are deleted, the others are replayed on the next open
+	newAckTracker(s.committed, s.commit).ack([]uint64{1, 2, 3, 4, 6})
+	assert.Nil(t, s.close())
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	assert.Len(t, files, len(s.segments))
+	// The first segment kept holds the first document not acknowledged
+	assert.True(t, s.segments[0] > 1 && s.segments[0] <= 5)
+
+	s, err = openSpool(cfg, FromLogger(gTestLogger))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), s.pending)
+	docs := spoolDocs(t, s)
+	assert.Len(t, docs, 6)
+	assert.Equal(t, "4", docs[0].ID)
+	assert.Equal(t, uint64(5), docs[0].seq)
+	assert.Equal(t, "k", docs[0].PartitionKey)
+	assert.Equal(t, `{"n":4}`, string(docs[0].RawContent))
+	assert.True(t, docs[0].size > 0)
+
+	// New documents are numbered after the spooled ones
+	doc := &Document{ID: "10", Content: `{"n":10}`}
+	assert.Nil(t, s.append(doc, nil))
+	assert.Equal(t, uint64(11), doc.seq)
+
+	seqs := []uint64{}
+	for _, d := range docs {
+		seqs = append(seqs, d.seq)
+	}
+	newAckTracker(s.committed, s.commit).ack(append(seqs, doc.seq))
+	assert.Nil(t, s.close())
+	files, _ = filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	assert.Len(t, files, 1)
+
+	s, err = openSpool(cfg, FromLogger(gTestLogger))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), s.pending)
+	assert.Empty(t, spoolDocs(t, s))
+	assert.Nil(t, s.close())
+
+	// Encoding errors are returned
+	assert.NotNil(t, s.append(&Document{Content: make(chan int)}, nil))
+}
+
+func TestSpool_TornWrite(t *testing.T) {
+	dir := newTestSpoolDir(t)
+	defer os.RemoveAll(dir)
+	cfg := SpoolConfig{Dir: dir}
+
+	s, err := openSpool(cfg, FromLogger(gTestLogger))
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, s.append(&Document{ID: strconv.Itoa(i), Content: `{}`}, nil))
+	}
+	assert.Nil(t, s.close())
+
+	// The process died while writing the last document
+	path := s.segmentPath(1)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(path, info.Size()-3))
+
+	s, err = openSpool(cfg, FromLogger(gTestLogger))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), s.pending)
+	doc := &Document{ID: "3", Content: `{}`}
+	assert.Nil(t, s.append(doc, nil))
+	assert.Equal(t, uint64(3), doc.seq)
+	assert.Nil(t, s.close())
+
+	s, err = openSpool(cfg, FromLogger(gTestLogger))
+	assert.Nil(t, err)
+	docs := spoolDocs(t, s)
+	assert.Len(t, docs, 3)
+	assert.Equal(t, "3", docs[2].ID)
+	assert.Nil(t, s.close())
+}
+
+func TestSpoolConfig_Validate(t *testing.T) {
+	assert.Nil(t, SpoolConfig{}.validate())
+	assert.Nil(t, SpoolConfig{Dir: "/tmp/spool", SegmentBytes: 1 << 20, Fsync: true}.validate())
+	assert.NotNil(t, SpoolConfig{Fsync: true}.validate())
+	assert.NotNil(t, SpoolConfig{Dir: "/tmp/spool", SegmentBytes: -1}.validate())
+}
+
+func TestWorkgroup_StartSpool(t *testing.T) {
+	dir := newTestSpoolDir(t)
+	defer os.RemoveAll(dir)
+	cfg := testCfg
+	cfg.Spool = SpoolConfig{Dir: dir, SegmentBytes: 4096}
+
+	// The cluster fails, the documents stay in the spool
+	failing := newFailingServer("/_bulk")
+	defer failing.Close()
+	_, err := NewWorkgroup(failing.URL, cfg, &versionedProducer{count: 1000}, gTestLogger).
+		Start(context.Background()).Wait()
+	assert.NotNil(t, err)
+
+	// The next run sends them before the new ones
+	srv := newCountingBulkServer()
+	defer srv.Close()
+	report, err := NewWorkgroup(srv.URL, cfg, &versionedProducer{}, gTestLogger).
+		Start(context.Background()).Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1000), report.Replayed)
+	assert.Equal(t, uint64(1000), report.Indexed)
+	assert.Equal(t, 1000, srv.count())
+
+	// All the documents are acknowledged
+	s, err := openSpool(cfg.Spool, FromLogger(gTestLogger))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), s.pending)
+	assert.Len(t, s.segments, 1)
+	assert.Nil(t, s.close())
+
+	// The spool needs a single target
+	cfg.Targets = []TargetConfig{{URL: srv.URL}}
+	_, err = NewWorkgroup(srv.URL, cfg, &versionedProducer{}, gTestLogger).Start(context.Background()).Wait()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,75 @@
+package elasticwg
+
+import "sync/atomic"
+
+// runStats document counters shared by the producer & the consumers of a run
+type runStats struct {
+	produced uint64
+	indexed  uint64
+	rejected uint64
+	skipped  uint64
+	// failedOver documents accepted by the failover cluster
+	failedOver uint64
+	// replayed documents sent again from the spool
+	replayed uint64
+}
+
+func (s *runStats) addProduced(n uint64) {
+	if s != nil {
+		atomic.AddUint64(&s.produced, n)
+	}
+}
+
+func (s *runStats) addIndexed(n uint64) {
+	if s != nil {
+		atomic.AddUint64(&s.indexed, n)
+	}
+}
+
+func (s *runStats) addRejected(n uint64) {
+	if s != nil {
+		atomic.AddUint64(&s.rejected, n)
+	}
+}
+
+func (s *runStats) getProduced() uint64 {
+	return atomic.LoadUint64(&s.produced)
+}
+
+func (s *runStats) getIndexed() uint64 {
+	return atomic.LoadUint64(&s.indexed)
+}
+
+func (s *runStats) getRejected() uint64 {
+	return atomic.LoadUint64(&s.rejected)
+}
+
+func (s *runStats) addSkipped(n uint64) {
+	if s != nil {
+		atomic.AddUint64(&s.skipped, n)
+	}
+}
+
+func (s *runStats) getSkipped() uint64 {
+	return atomic.LoadUint64(&s.skipped)
+}
+
+func (s *runStats) addFailedOver(n uint64) {
+	if s != nil {
+		atomic.AddUint64(&s.failedOver, n)
+	}
+}
+
+func (s *runStats) getFailedOver() uint64 {
+	return atomic.LoadUint64(&s.failedOver)
+}
+
+func (s *runStats) addReplayed(n uint64) {
+	if s != nil {
+		atomic.AddUint64(&s.replayed, n)
+	}
+}
+
+func (s *runStats) getReplayed() uint64 {
+	return atomic.LoadUint64(&s.replayed)
+}
@@ -0,0 +1,145 @@
+package elasticwg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/olivere/elastic.v5"
+	"strconv"
+)
+
+const defaultSyncField = "elasticwg_generation"
+
+// SyncConfig sync mode configuration, deleting the documents not sent by the run once it succeeded
+// Documents are stamped with the run generation in Field (elasticwg_generation if not set), then the documents
+// of the index & the type without the current generation are deleted, only among the ones matching Scope if set,
+// a JSON query such as a tenant filter. The run fails without deleting anything when more than MaxDeletes
+// documents would be deleted, -1 allows any number, or when documents were rejected, as their previous version
+// isn't stamped. It is incompatible with the incremental mode, & meant for loads into the live index: its
+// replicas & refresh interval are left untouched & the index is refreshed before deleting
+type SyncConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Field      string `yaml:"field"`
+	Scope      string `yaml:"scope"`
+	MaxDeletes int64  `yaml:"max-deletes"`
+}
+
+// field returns the field documents are stamped in
+func (sc SyncConfig) field() string {
+	if sc.Field == "" {
+		return defaultSyncField
+	}
+	return sc.Field
+}
+
+func (sc SyncConfig) validate() error {
+	if !sc.Enabled {
+		return nil
+	}
+
+	if sc.MaxDeletes == 0 || sc.MaxDeletes < -1 {
+		return errors.New("sync max deletes must be > 0, or -1 for no limit")
+	}
+	return nil
+}
+
+// staleQuery returns the query matching the documents of the scope not stamped with generation
+func (sc SyncConfig) staleQuery(generation int64) elastic.Query {
+	q := elastic.NewBoolQuery().MustNot(elastic.NewTermQuery(sc.field(), generation))
+	if sc.Scope != "" {
+		q = q.Filter(elastic.NewRawStringQuery(sc.Scope))
+	}
+	return q
+}
+
+// syncStamp returns the JSON member stamping the documents with generation
+func syncStamp(field string, generation int64) []byte {
+	buf := &bytes.Buffer{}
+	writeJSONString(buf, field)
+	buf.WriteByte(':')
+	buf.WriteString(strconv.FormatInt(generation, 10))
+	return buf.Bytes()
+}
+
+// writeStamped writes the JSON object source with stamp as its first member
+// A stamp already in the source, such as documents reindexed from a synced index, is replaced: Elasticsearch
+// keeping the last of duplicate members, the previous generation would win & the document be deleted
+func writeStamped(buf *bytes.Buffer, source, stamp []byte) error {
+	key := stamp[:bytes.LastIndexByte(stamp, ':')]
+	if bytes.Contains(source, key) {
+		stripped, err := withoutMember(source, key)
+		if err != nil {
+			return err
+		}
+		source = stripped
+	}
+
+	start := bytes.IndexByte(source, '{')
+	if start < 0 || len(bytes.TrimSpace(source[:start])) > 0 {
+		return errors.New("sync mode needs JSON object documents")
+	}
+
+	buf.WriteByte('{')
+	buf.Write(stamp)
+	rest := source[start+1:]
+	if trimmed := bytes.TrimSpace(rest); len(trimmed) == 0 || trimmed[0] != '}' {
+		buf.WriteByte(',')
+	}
+	buf.Write(rest)
+	return nil
+}
+
+// withoutMember returns the JSON object source without its member named by the JSON string key
+func withoutMember(source, key []byte) ([]byte, error) {
+	var name string
+	if err := json.Unmarshal(key, &name); err != nil {
+		return nil, err
+	}
+	members := map[string]json.RawMessage{}
+	if err := json.Unmarshal(source, &members); err != nil {
+		return nil, errors.New("sync mode needs JSON object documents")
+	}
+	if _, ok := members[name]; !ok {
+		return source, nil
+	}
+	delete(members, name)
+	return json.Marshal(members)
+}
+
+// deleteStale deletes the documents not sent by the run, once they are all searchable
+func (w *Workgroup) deleteStale(ctx context.Context, client *elastic.Client, generation int64) (int64, error) {
+	sc := w.cfg.Sync
+	if _, err := client.Refresh(w.cfg.IndexName).Do(ctx); err != nil {
+		return 0, err
+	}
+
+	count := client.Count(w.cfg.IndexName).Query(sc.staleQuery(generation))
+	if w.cfg.DocType != "" {
+		count = count.Type(w.cfg.DocType)
+	}
+	stale, err := count.Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if sc.MaxDeletes >= 0 && stale > sc.MaxDeletes {
+		return 0, fmt.Errorf("sync would delete %d documents, more than the %d allowed", stale, sc.MaxDeletes)
+	}
+	if stale == 0 {
+		return 0, nil
+	}
+
+	deletion := client.DeleteByQuery(w.cfg.IndexName).Query(sc.staleQuery(generation)).ProceedOnVersionConflict()
+	if w.cfg.DocType != "" {
+		deletion = deletion.Type(w.cfg.DocType)
+	}
+	res, err := deletion.Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Failures) > 0 {
+		return res.Deleted, fmt.Errorf("sync failed to delete %d documents", len(res.Failures))
+	}
+	return res.Deleted, nil
+}
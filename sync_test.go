@@ -0,0 +1,211 @@
+package elasticwg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSyncConfig_Validate(t *testing.T) {
+	assert.Nil(t, SyncConfig{}.validate())
+	assert.NotNil(t, SyncConfig{Enabled: true}.validate())
+	assert.NotNil(t, SyncConfig{Enabled: true, MaxDeletes: -2}.validate())
+	assert.Nil(t, SyncConfig{Enabled: true, MaxDeletes: -1}.validate())
+	assert.Nil(t, SyncConfig{Enabled: true, MaxDeletes: 100}.validate())
+}
+
+func TestSyncConfig_StaleQuery(t *testing.T) {
+	src, err := SyncConfig{}.staleQuery(42).Source()
+	assert.Nil(t, err)
+	b, _ := json.Marshal(src)
+	assert.JSONEq(t, `{"bool":{"must_not":{"term":{"elasticwg_generation":42}}}}`, string(b))
+
+	src, err = SyncConfig{Field: "gen", Scope: `{"term":{"tenant":"a"}}`}.staleQuery(42).Source()
+	assert.Nil(t, err)
+	b, _ = json.Marshal(src)
+	assert.JSONEq(t, `{"bool":{"filter":{"term":{"tenant":"a"}},"must_not":{"term":{"gen":42}}}}`, string(b))
+}
+
+func TestWriteStamped(t *testing.T) {
+	stamp := syncStamp("gen", 42)
+	for source, expected := range map[string]string{
+		`{"a":1}`:        `{"gen":42,"a":1}`,
+		`{}`:             `{"gen":42}`,
+		" {  } ":         `{"gen":42  } `,
+		` {"a":{"b":2}}`: `{"gen":42,"a":{"b":2}}`,
+		// The stamp of a previous run is replaced
+		`{"a":1,"gen":7}`:       `{"gen":42,"a":1}`,
+		`{"gen":7}`:             `{"gen":42}`,
+		`{"a":{"gen":7},"b":2}`: `{"gen":42,"a":{"gen":7},"b":2}`,
+	} {
+		buf := &bytes.Buffer{}
+		assert.Nil(t, writeStamped(buf, []byte(source), stamp))
+		assert.Equal(t, expected, buf.String(), source)
+		assert.True(t, json.Valid(buf.Bytes()), source)
+	}
+
+	for _, source := range []string{`[1]`, `"string"`, `1{`, `["gen"]`} {
+		assert.NotNil(t, writeStamped(&bytes.Buffer{}, []byte(source), stamp), source)
+	}
+}
+
+// testSyncServer a test server counting the bulk documents stamped with a generation, the settings changes
+// & the deletions, the bulk items being rejected if reject is set
+type testSyncServer struct {
+	*httptest.Server
+	stale     int64
+	reject    bool
+	stamped   int64
+	unstamped int64
+	refreshed int64
+	settings  int64
+	// generations the generations the documents are stamped with
+	generations map[float64]int
+	deletes     int64
+	mu          sync.Mutex
+	query       string
+}
+
+func newTestSyncServer(stale int64, reject bool) *testSyncServer {
+	s := &testSyncServer{stale: stale, reject: reject, generations: map[float64]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		res := `{}`
+		switch {
+		case r.URL.Path == "/_bulk":
+			lines := bytes.Split(bytes.TrimSpace(body), []byte("\n"))
+			var items []map[string]*elastic.BulkResponseItem
+			for i := 1; i < len(lines); i += 2 {
+				var doc map[string]interface{}
+				json.Unmarshal(lines[i], &doc)
+				if gen, ok := doc[defaultSyncField]; ok {
+					atomic.AddInt64(&s.stamped, 1)
+					s.mu.Lock()
+					s.generations[gen.(float64)]++
+					s.mu.Unlock()
+				} else {
+					atomic.AddInt64(&s.unstamped, 1)
+				}
+				items = append(items, map[string]*elastic.BulkResponseItem{"index": {Status: http.StatusBadRequest,
+					Error: &elastic.ErrorDetails{Reason: "mapper_parsing_exception"}}})
+			}
+			if s.reject {
+				b, _ := json.Marshal(elastic.BulkResponse{Errors: true, Items: items})
+				res = string(b)
+			}
+		case strings.HasSuffix(r.URL.Path, "/_settings"):
+			atomic.AddInt64(&s.settings, 1)
+		case strings.HasSuffix(r.URL.Path, "/_refresh"):
+			atomic.AddInt64(&s.refreshed, 1)
+		case strings.HasSuffix(r.URL.Path, "/_count"):
+			s.mu.Lock()
+			s.query = string(body)
+			s.mu.Unlock()
+			b, _ := json.Marshal(map[string]int64{"count": s.stale})
+			res = string(b)
+		case strings.HasSuffix(r.URL.Path, "/_delete_by_query"):
+			atomic.AddInt64(&s.deletes, 1)
+			b, _ := json.Marshal(map[string]int64{"deleted": s.stale})
+			res = string(b)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(res))
+	}))
+	return s
+}
+
+func TestWorkgroup_StartSync(t *testing.T) {
+	srv := newTestSyncServer(30, false)
+	defer srv.Close()
+
+	cfg := testCfg
+	cfg.Sync = SyncConfig{Enabled: true, MaxDeletes: 100}
+	wg := NewWorkgroup(srv.URL, cfg, &countProducer{count: 1000}, gTestLogger)
+	report, err := wg.Start(context.Background()).Wait()
+	assert.Nil(t, err)
+	assert.True(t, report.Generation > 0)
+	assert.Equal(t, int64(30), report.Deleted)
+
+	assert.Equal(t, int64(1000), atomic.LoadInt64(&srv.stamped))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&srv.unstamped))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&srv.refreshed))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&srv.deletes))
+	// The settings of the live index are left untouched
+	assert.Equal(t, int64(0), atomic.LoadInt64(&srv.settings))
+	srv.mu.Lock()
+	assert.Contains(t, srv.query, `"elasticwg_generation":`+strconv.FormatInt(report.Generation, 10))
+	srv.mu.Unlock()
+}
+
+func TestWorkgroup_StartSyncTooManyDeletes(t *testing.T) {
+	srv := newTestSyncServer(101, false)
+	defer srv.Close()
+
+	cfg := testCfg
+	cfg.Sync = SyncConfig{Enabled: true, MaxDeletes: 100}
+	wg := NewWorkgroup(srv.URL, cfg, &countProducer{count: 1000}, gTestLogger)
+	report, err := wg.Start(context.Background()).Wait()
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(0), report.Deleted)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&srv.deletes))
+}
+
+// restampProducer pushes documents reindexed from a synced index, stamped with a previous generation
+type restampProducer struct{}
+
+func (restampProducer) Produce(pe *Producer) {
+	for i := 0; i < 100; i++ {
+		pe.Push(&Document{ID: strconv.Itoa(i), Content: map[string]int{defaultSyncField: 1, "n": i}})
+	}
+}
+
+func TestWorkgroup_StartSyncRestamped(t *testing.T) {
+	srv := newTestSyncServer(0, false)
+	defer srv.Close()
+
+	// The documents only hold the run generation
+	cfg := testCfg
+	cfg.Sync = SyncConfig{Enabled: true, MaxDeletes: -1}
+	report, err := NewWorkgroup(srv.URL, cfg, restampProducer{}, gTestLogger).Start(context.Background()).Wait()
+	assert.Nil(t, err)
+	srv.mu.Lock()
+	assert.Equal(t, map[float64]int{float64(report.Generation): 100}, srv.generations)
+	srv.mu.Unlock()
+}
+
+func TestWorkgroup_StartSyncRejected(t *testing.T) {
+	srv := newTestSyncServer(10, true)
+	defer srv.Close()
+
+	// The previous version of the rejected documents isn't deleted
+	cfg := testCfg
+	cfg.Sync = SyncConfig{Enabled: true, MaxDeletes: -1}
+	wg := NewWorkgroup(srv.URL, cfg, &countProducer{count: 200}, gTestLogger)
+	report, err := wg.Start(context.Background()).Wait()
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(200), report.Rejected)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&srv.deletes))
+}
+
+func TestWorkgroup_StartSyncIncremental(t *testing.T) {
+	srv := newTestSyncServer(0, false)
+	defer srv.Close()
+
+	cfg := testCfg
+	cfg.Sync = SyncConfig{Enabled: true, MaxDeletes: -1}
+	wg := NewWorkgroup(srv.URL, cfg, &countProducer{count: 10}, gTestLogger)
+	wg.SetFingerprintStore(newMapStore())
+	_, err := wg.Start(context.Background()).Wait()
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&srv.stamped))
+}
@@ -0,0 +1,406 @@
+package elasticwg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/olivere/elastic.v5"
+	"sync"
+	"time"
+)
+
+const primaryTargetName = "primary"
+
+// TargetConfig an additional cluster the documents are written to, with its own index setup, consumers,
+// retries & report. Name identifies it in the logs, events, metrics & report, the URL if not set.
+// The run fails when a target fails, unless it is Optional: its documents are then dropped while the
+// other targets go on
+type TargetConfig struct {
+	Name       string           `yaml:"name"`
+	URL        string           `yaml:"url"`
+	Connection ConnectionConfig `yaml:"connection"`
+	Optional   bool             `yaml:"optional"`
+}
+
+// TargetReport the summary of a run on one target
+// Err is the error the target failed with, if any
+type TargetReport struct {
+	Name      string
+	URL       string
+	Indexed   uint64
+	Rejected  uint64
+	Deleted   int64
+	BulkSize  int
+	Consumers int
+	Err       error
+}
+
+// target a cluster the run writes the documents to
+type target struct {
+	name        string
+	url         string
+	conn        ConnectionConfig
+	optional    bool
+	client      *elastic.Client
+	compression string
+	ctx         context.Context
+	cancel      context.CancelFunc
+	log         StructuredLogger
+	events      *runEvents
+	metrics     Metrics
+	stats       *runStats
+	budget      *memoryBudget
+	gate        *pauseGate
+	adaptive    *adaptiveController
+	breaker     *breaker
+	channels    []chan *Document
+	consumers   int
+	failover    *failover
+	esConfig    IndexConfig
+	deleted     int64
+	wg          sync.WaitGroup
+	failOnce    sync.Once
+	onRunFail   func(error)
+	mu          sync.Mutex
+	err         error
+}
+
+// newTargets returns the primary target & the additional targets of the run
+// The primary target shares the run stats, so the run progress & report follow it
+func (w *Workgroup) newTargets(ctx context.Context, r *run) []*target {
+	fanOut := len(w.cfg.Targets) > 0
+	configs := append([]TargetConfig{{Name: primaryTargetName, URL: w.elasticURL, Connection: w.cfg.Connection}},
+		w.cfg.Targets...)
+
+	targets := make([]*target, 0, len(configs))
+	for i, tc := range configs {
+		t := &target{
+			name:        tc.Name,
+			url:         tc.URL,
+			conn:        tc.Connection,
+			optional:    tc.Optional,
+			compression: w.cfg.Compression,
+			log:         r.log,
+			events:      r.events,
+			metrics:     w.metrics,
+			stats:       r.stats,
+			budget:      r.budget,
+			gate:        r.gate.child(),
+			onRunFail:   r.fail,
+		}
+		if t.name == "" {
+			t.name = t.url
+		}
+		t.ctx, t.cancel = context.WithCancel(ctx)
+
+		if fanOut {
+			t.log = r.log.With(F("target", t.name))
+			t.events = &runEvents{bus: w.events, runID: r.id, index: w.cfg.IndexName, target: t.name}
+		}
+		if i > 0 {
+			t.metrics = targetMetrics{Metrics: w.metrics, label: w.cfg.IndexName + "@" + t.name}
+			t.stats = &runStats{}
+		}
+
+		// In partitioned mode, each consumer has its own channel
+		t.channels = []chan *Document{make(chan *Document, w.cfg.ChannelBufferSize)}
+		for w.cfg.Partitioned && len(t.channels) < w.cfg.NumConsumers {
+			t.channels = append(t.channels, make(chan *Document, w.cfg.ChannelBufferSize))
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// fail records the error the target failed with
+// A required target fails the run, an optional one stops & drops its documents
+func (t *target) fail(err error) {
+	t.failOnce.Do(func() {
+		t.mu.Lock()
+		t.err = err
+		t.mu.Unlock()
+
+		if !t.optional {
+			t.onRunFail(err)
+			return
+		}
+
+		t.log.Error("Optional target failed, dropping its documents", F("error", err))
+		t.cancel()
+		for _, cDoc := range t.channels {
+			go t.drain(cDoc)
+		}
+	})
+}
+
+// failure returns the error the target failed with, if any
+func (t *target) failure() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// drain drops the documents of a failed target until production is finished
+func (t *target) drain(cDoc chan *Document) {
+	for doc := range cDoc {
+		t.budget.release(doc.size)
+		t.stats.addRejected(1)
+	}
+}
+
+// setupTarget creates the target client, index & mapping, & applies the loading settings
+// A resumed run reuses the index. The settings of the live index loaded in sync mode are left untouched
+func (w *Workgroup) setupTarget(ctx context.Context, r *run, t *target, primary bool) error {
+	// The client set on the workgroup is used for the primary target
+	if primary && w.client != nil {
+		t.client = w.client
+		if t.compression != "" {
+			// The content encoding header can only be added by the clients created by the workgroup
+			t.log.Warn("Compression is not supported with a custom client, disabling it", F("compression", t.compression))
+			t.compression = ""
+		}
+	} else {
+		client, pool, err := newElasticClient(t.url, t.conn, w.httpClient, w.tracer)
+		if err != nil {
+			t.log.Error("Unable to create elasticsearch client", F("error", err))
+			return err
+		}
+		t.client = client
+		go func() {
+			<-t.ctx.Done()
+			pool.Stop()
+		}()
+	}
+
+	if err := w.traceStep(ctx, "elasticwg.CreateIndex", func(ctx context.Context) error {
+		_, err := t.client.CreateIndex(w.cfg.IndexName).Do(ctx)
+		return err
+	}); err != nil {
+		if w.FailureOnDupIndex && r.resumedFrom == "" {
+			t.log.Error("Unable to create elasticsearch index", F("error", err))
+			return err
+		}
+	} else {
+		t.events.publish(IndexCreated{EventMeta: t.events.meta()})
+	}
+
+	if w.indexMapping != nil {
+		if err := w.traceStep(ctx, "elasticwg.PutMapping", func(ctx context.Context) error {
+			_, err := t.client.PutMapping().Index(w.cfg.IndexName).Type(w.cfg.DocType).BodyJson(w.indexMapping).Do(ctx)
+			return err
+		}); err != nil {
+			t.log.Error("Unable to put elasticsearch index mapping", F("error", err))
+			return err
+		}
+	}
+
+	if w.cfg.Sync.Enabled {
+		return nil
+	}
+	t.esConfig.Index.NumberOfReplicas = 0
+	t.esConfig.Index.RefreshInterval = "-1"
+	if err := w.traceStep(ctx, "elasticwg.PutSettings", func(ctx context.Context) error {
+		_, err := t.client.IndexPutSettings(w.cfg.IndexName).BodyJson(t.esConfig).Do(ctx)
+		return err
+	}); err != nil {
+		t.log.Error("Unable to put elasticsearch index settings", F("error", err))
+		return err
+	}
+	t.events.publish(SettingsApplied{EventMeta: t.events.meta(), Settings: t.esConfig})
+	return nil
+}
+
+// startConsumers starts the breaker, the adaptive controller & the consumers of the target
+func (w *Workgroup) startConsumers(r *run, t *target, primary bool) {
+	if w.cfg.Breaker.Enabled {
+		t.breaker = newBreaker(w.cfg.Breaker, t.client, t.gate, t.log, t.events, t.fail)
+		go t.breaker.watch(t.ctx)
+	}
+
+	// In adaptive mode, the maximum number of consumers is started & the controller
+	// decides how many of them are active
+	t.consumers = w.cfg.NumConsumers
+	t.metrics.SetBulkSettings(w.cfg.IndexName, w.cfg.BulkSize, t.consumers)
+	if w.cfg.Adaptive.Enabled {
+		t.adaptive = newAdaptiveController(w.cfg, func(bulkSize, consumers int) {
+			t.metrics.SetBulkSettings(w.cfg.IndexName, bulkSize, consumers)
+			t.log.Debug("Adaptive bulk settings changed", F("bulk_size", bulkSize), F("consumers", consumers))
+		})
+		bulkSize, consumers := t.adaptive.state()
+		t.metrics.SetBulkSettings(w.cfg.IndexName, bulkSize, consumers)
+		t.consumers = t.adaptive.cfg.MaxConsumers
+	}
+
+	inFlight := newSemaphore(w.cfg.MaxInFlight)
+	var stamp []byte
+	if w.cfg.Sync.Enabled {
+		stamp = syncStamp(w.cfg.Sync.field(), r.generation)
+	}
+	// Only the primary target records the fingerprints, incremental mode being single target
+	var fingerprints FingerprintStore
+	var acks *ackTracker
+	if primary {
+		fingerprints = w.fingerprints
+		acks = r.acks
+	}
+
+	for i := 0; i < t.consumers; i++ {
+		t.wg.Add(1)
+		c := Consumer{
+			BulkSize:     w.cfg.BulkSize,
+			ElasticURL:   t.url,
+			DocType:      w.cfg.DocType,
+			Index:        w.cfg.IndexName,
+			client:       t.client,
+			ctx:          t.ctx,
+			tracer:       w.tracer,
+			metrics:      t.metrics,
+			stats:        t.stats,
+			id:           i,
+			events:       t.events,
+			gate:         t.gate,
+			limiter:      r.limiter,
+			adaptive:     t.adaptive,
+			breaker:      t.breaker,
+			maxInFlight:  w.cfg.MaxInFlightPerConsumer,
+			inFlight:     inFlight,
+			budget:       t.budget,
+			encoder:      w.encoder,
+			compression:  t.compression,
+			bulkBytes:    w.cfg.BulkBytes,
+			fingerprints: fingerprints,
+			failover:     t.failover,
+			acks:         acks,
+			stamp:        stamp,
+			onAbort:      t.fail,
+			logger:       t.log.With(F("consumer_id", i)),
+		}
+
+		// Set the consumer callback function if defined on the workgroup, for the primary target
+		if w.onPushCallback != nil && primary {
+			c.onPushCallback = w.onPushCallback
+		}
+		if primary {
+			c.onAckCallback = w.onAckCallback
+		}
+
+		go c.Consume(t.channels[i%len(t.channels)], &t.wg)
+	}
+}
+
+// finishTarget deletes the stale documents in sync mode, or restores the index settings
+func (w *Workgroup) finishTarget(ctx context.Context, r *run, t *target) error {
+	if w.cfg.Sync.Enabled {
+		return w.syncTarget(ctx, r, t)
+	}
+
+	// Re-set ES index standard configs
+	t.esConfig.Index.NumberOfReplicas = 1
+	t.esConfig.Index.RefreshInterval = "10s"
+	if err := w.traceStep(ctx, "elasticwg.RestoreSettings", func(ctx context.Context) error {
+		_, err := t.client.IndexPutSettings(w.cfg.IndexName).BodyJson(t.esConfig).Do(ctx)
+		return err
+	}); err != nil {
+		t.log.Error("Unable to put elasticsearch index settings", F("error", err))
+		return err
+	}
+	t.events.publish(SettingsApplied{EventMeta: t.events.meta(), Settings: t.esConfig, Restored: true})
+	return nil
+}
+
+// syncTarget deletes the documents of the target not sent by the run
+// Documents rejected keep their previous version without the run generation, so nothing is deleted & the run
+// fails, documents failed over being kept as well
+func (w *Workgroup) syncTarget(ctx context.Context, r *run, t *target) error {
+	// The producer rejections are accounted by the run stats, shared by the primary target
+	rejected := r.stats.getRejected()
+	if t.stats != r.stats {
+		rejected += t.stats.getRejected()
+	}
+	if rejected > 0 {
+		t.log.Error("Documents rejected, not deleting the stale documents", F("documents", rejected))
+		return fmt.Errorf("sync aborted, %d documents were rejected", rejected)
+	}
+	if t.stats.getFailedOver() > 0 && t.failover != nil {
+		t.log.Warn("Documents failed over, not deleting the stale documents", F("documents", t.stats.getFailedOver()))
+		return nil
+	}
+
+	if err := w.traceStep(ctx, "elasticwg.Sync", func(ctx context.Context) error {
+		deleted, err := w.deleteStale(ctx, t.client, r.generation)
+		t.deleted = deleted
+		return err
+	}); err != nil {
+		t.log.Error("Unable to delete the stale documents", F("error", err))
+		return err
+	}
+	t.log.Info("Stale documents deleted", F("documents", t.deleted), F("generation", r.generation))
+	return nil
+}
+
+// report summarizes the run on the target
+func (t *target) report(cfg WorkgroupConfig) TargetReport {
+	report := TargetReport{
+		Name:      t.name,
+		URL:       t.url,
+		Indexed:   t.stats.getIndexed(),
+		Rejected:  t.stats.getRejected(),
+		Deleted:   t.deleted,
+		BulkSize:  cfg.BulkSize,
+		Consumers: cfg.NumConsumers,
+		Err:       t.failure(),
+	}
+	if t.adaptive != nil {
+		report.BulkSize, report.Consumers = t.adaptive.state()
+	}
+	return report
+}
+
+// validateTargets checks the additional targets of the configuration
+func validateTargets(targets []TargetConfig) error {
+	names := map[string]bool{primaryTargetName: true}
+	for _, tc := range targets {
+		if tc.URL == "" {
+			return errors.New("targets must have an URL")
+		}
+		name := tc.Name
+		if name == "" {
+			name = tc.URL
+		}
+		if names[name] {
+			return errors.New("targets names must be unique & differ from " + primaryTargetName)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+// targetMetrics labels the metrics of an additional target with its own index label
+type targetMetrics struct {
+	Metrics
+	label string
+}
+
+func (m targetMetrics) AddDocuments(_ string, outcome Outcome, n int) {
+	m.Metrics.AddDocuments(m.label, outcome, n)
+}
+
+func (m targetMetrics) AddBulks(_ string, outcome Outcome, n int) {
+	m.Metrics.AddBulks(m.label, outcome, n)
+}
+
+func (m targetMetrics) ObserveBulk(_ string, latency time.Duration, bytes int64) {
+	m.Metrics.ObserveBulk(m.label, latency, bytes)
+}
+
+func (m targetMetrics) SetChannelOccupancy(_ string, n int) {
+	m.Metrics.SetChannelOccupancy(m.label, n)
+}
+
+func (m targetMetrics) AddActiveConsumers(_ string, delta int) {
+	m.Metrics.AddActiveConsumers(m.label, delta)
+}
+
+func (m targetMetrics) SetBulkSettings(_ string, bulkSize, consumers int) {
+	m.Metrics.SetBulkSettings(m.label, bulkSize, consumers)
+}
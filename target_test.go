@@ -0,0 +1,143 @@
+package elasticwg
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// countingBulkServer accepts all the documents & counts them by ID
+type countingBulkServer struct {
+	*httptest.Server
+	mu  sync.Mutex
+	ids map[string]int
+}
+
+func newCountingBulkServer() *countingBulkServer {
+	s := &countingBulkServer{ids: map[string]int{}}
+	s.Server = newTestBulkServer(func(id string) bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.ids[id]++
+		return false
+	})
+	return s
+}
+
+func (s *countingBulkServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ids)
+}
+
+// newFailingServer answers the requests on path with an error
+func newFailingServer(path string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == path {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+}
+
+func TestValidateTargets(t *testing.T) {
+	assert.Nil(t, validateTargets(nil))
+	assert.Nil(t, validateTargets([]TargetConfig{{URL: "http://a"}, {Name: "b", URL: "http://a"}}))
+	assert.NotNil(t, validateTargets([]TargetConfig{{Name: "a"}}))
+	assert.NotNil(t, validateTargets([]TargetConfig{{URL: "http://a"}, {URL: "http://a"}}))
+	assert.NotNil(t, validateTargets([]TargetConfig{{Name: primaryTargetName, URL: "http://a"}}))
+}
+
+func TestWorkgroup_StartTargets(t *testing.T) {
+	primary := newCountingBulkServer()
+	defer primary.Close()
+	dr := newCountingBulkServer()
+	defer dr.Close()
+
+	var mu sync.Mutex
+	targets := map[string]int{}
+
+	cfg := testCfg
+	cfg.Targets = []TargetConfig{{Name: "dr", URL: dr.URL}}
+	wg := NewWorkgroup(primary.URL, cfg, &versionedProducer{count: 1000}, gTestLogger)
+	wg.Subscribe(func(e Event) {
+		if sent, ok := e.(BulkSent); ok {
+			mu.Lock()
+			targets[sent.Target] += sent.Actions
+			mu.Unlock()
+		}
+	})
+	report, err := wg.Start(context.Background()).Wait()
+	assert.Nil(t, err)
+
+	// Each cluster receives all the documents
+	assert.Equal(t, 1000, primary.count())
+	assert.Equal(t, 1000, dr.count())
+	assert.Equal(t, uint64(1000), report.Produced)
+	assert.Equal(t, uint64(1000), report.Indexed)
+	assert.Len(t, report.Targets, 2)
+	for _, tr := range report.Targets {
+		assert.Equal(t, uint64(1000), tr.Indexed)
+		assert.Nil(t, tr.Err)
+	}
+	assert.Equal(t, "dr", report.Targets[1].Name)
+
+	// Events are attributed to their target
+	mu.Lock()
+	assert.Equal(t, map[string]int{primaryTargetName: 1000, "dr": 1000}, targets)
+	mu.Unlock()
+}
+
+func TestWorkgroup_StartTargetsFailure(t *testing.T) {
+	primary := newCountingBulkServer()
+	defer primary.Close()
+	failing := newFailingServer("/test_index/_settings")
+	defer failing.Close()
+	failingBulks := newFailingServer("/_bulk")
+	defer failingBulks.Close()
+
+	// A failed optional target drops its documents, whether it fails on setup or while consuming
+	for _, url := range []string{failing.URL, failingBulks.URL} {
+		cfg := testCfg
+		cfg.MemoryBudget = 1 << 16
+		cfg.Targets = []TargetConfig{{Name: "dr", URL: url, Optional: true}}
+		report, err := NewWorkgroup(primary.URL, cfg, &versionedProducer{count: 1000}, gTestLogger).
+			Start(context.Background()).Wait()
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(1000), report.Indexed)
+		assert.Len(t, report.Targets, 2)
+		assert.Nil(t, report.Targets[0].Err)
+		assert.NotNil(t, report.Targets[1].Err)
+		assert.Equal(t, uint64(0), report.Targets[1].Indexed)
+	}
+	assert.Equal(t, 1000, primary.count())
+
+	// A failed required target fails the run
+	cfg := testCfg
+	cfg.Targets = []TargetConfig{{Name: "dr", URL: failing.URL}}
+	_, err := NewWorkgroup(primary.URL, cfg, &versionedProducer{count: 1000}, gTestLogger).
+		Start(context.Background()).Wait()
+	assert.NotNil(t, err)
+}
+
+// indexMetrics records the index label of the documents metrics
+type indexMetrics struct {
+	nopMetrics
+	indices []string
+}
+
+func (m *indexMetrics) AddDocuments(index string, outcome Outcome, n int) {
+	m.indices = append(m.indices, index)
+}
+
+func TestTargetMetrics(t *testing.T) {
+	m := &indexMetrics{}
+	tm := targetMetrics{Metrics: m, label: "index@dr"}
+	tm.AddDocuments("index", OutcomeIndexed, 3)
+	assert.Equal(t, []string{"index@dr"}, m.indices)
+}
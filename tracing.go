@@ -0,0 +1,64 @@
+package elasticwg
+
+import (
+	"context"
+	"net/http"
+)
+
+// Attribute a key/value pair describing a Span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span a traced unit of work, started by a Tracer
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Tracer tracing interface intended to be implemented for this library
+// Start creates a span child of the one carried by ctx, Inject propagates the
+// span carried by ctx into the headers of an outgoing HTTP request
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+	Inject(ctx context.Context, header http.Header)
+}
+
+// nopTracer the Tracer used when none is set on the workgroup
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, _ string, _ ...Attribute) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+func (nopTracer) Inject(context.Context, http.Header) {}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(...Attribute) {}
+func (nopSpan) RecordError(error)          {}
+func (nopSpan) End()                       {}
+
+// tracingTransport propagates the trace context of each request through the Tracer
+type tracingTransport struct {
+	base   http.RoundTripper
+	tracer Tracer
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	t.tracer.Inject(req.Context(), r.Header)
+
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(r)
+}
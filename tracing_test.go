@@ -0,0 +1,43 @@
+package elasticwg
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testTracer struct {
+	nopTracer
+}
+
+func (testTracer) Inject(ctx context.Context, header http.Header) {
+	header.Set("traceparent", "00-test")
+}
+
+func TestTracingTransport(t *testing.T) {
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+
+	c := &http.Client{Transport: &tracingTransport{tracer: testTracer{}}}
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	_, err := c.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "00-test", traceparent)
+	assert.Empty(t, req.Header.Get("traceparent"))
+}
+
+func TestWorkgroup_SetTracer(t *testing.T) {
+	wg := NewWorkgroup(esURL, testCfg, &testProducer{}, gTestLogger)
+	assert.Equal(t, nopTracer{}, wg.tracer)
+
+	wg.SetTracer(testTracer{})
+	assert.Equal(t, testTracer{}, wg.tracer)
+
+	wg.SetTracer(nil)
+	assert.Equal(t, nopTracer{}, wg.tracer)
+}
@@ -5,22 +5,37 @@ import (
 	"encoding/json"
 	"gopkg.in/olivere/elastic.v5"
 	"io/ioutil"
-	"sync"
+	"net/http"
 	"time"
 )
 
 // Workgroup the main object intended to be used to process data
 type Workgroup struct {
-	elasticURL        string
-	cfg               WorkgroupConfig
-	p                 *Producer
-	logger            Logger
-	FailureOnDupIndex bool
-	indexMapping      map[string]interface{}
-	onStartupCallback func() bool
-	onFailureCallback func()
-	onFinishCallback  func()
-	onPushCallback    func(int)
+	elasticURL          string
+	cfg                 WorkgroupConfig
+	p                   *Producer
+	log                 StructuredLogger
+	FailureOnDupIndex   bool
+	indexMapping        map[string]interface{}
+	httpClient          *http.Client
+	client              *elastic.Client
+	metrics             Metrics
+	tracer              Tracer
+	onStartupCallback   func() bool
+	onFailureCallback   func()
+	onFinishCallback    func()
+	onPushCallback      func(int)
+	onAckCallback       func([]interface{}, []AckResult)
+	progressInterval    time.Duration
+	onProgressCallback  func(ProgressSnapshot)
+	events              *eventBus
+	limiter             *rateLimiter
+	encoder             Encoder
+	fingerprints        FingerprintStore
+	failoverJournal     FailoverJournal
+	checkpoints         CheckpointStore
+	rateLimitInterval   time.Duration
+	onRateLimitCallback func() RateLimit
 }
 
 // NewWorkgroup creates the workgroup and define the initialization parameters
@@ -29,33 +44,102 @@ func NewWorkgroup(esURL string, wcfg WorkgroupConfig, pi ProducerInterface, logg
 		return nil
 	}
 
+	log := FromLogger(logger)
 	if pi == nil {
-		logger.Error("ProducerInterface is nil!")
+		log.Error("ProducerInterface is nil!")
 		return nil
 	}
 
 	if wcfg.NumConsumers <= 0 {
-		logger.Error("consumerNumber must be > 0!")
+		log.Error("consumerNumber must be > 0!")
 		return nil
 	}
 
 	if wcfg.BulkSize <= 0 {
-		logger.Error("bulkSize must be > 0!")
+		log.Error("bulkSize must be > 0!")
 		return nil
 	}
 
 	if wcfg.ChannelBufferSize < 0 {
-		logger.Error("channelBufferSize must be >= 0!")
+		log.Error("channelBufferSize must be >= 0!")
+		return nil
+	}
+
+	if wcfg.MemoryBudget < 0 {
+		log.Error("memoryBudget must be >= 0!")
+		return nil
+	}
+
+	if wcfg.BulkBytes < 0 {
+		log.Error("bulkBytes must be >= 0!")
+		return nil
+	}
+
+	if wcfg.Compression != "" && wcfg.Compression != CompressionGzip {
+		log.Error("Unsupported compression", F("compression", wcfg.Compression))
+		return nil
+	}
+
+	if wcfg.MaxInFlightPerConsumer < 0 || wcfg.MaxInFlight < 0 {
+		log.Error("maxInFlight must be >= 0!")
+		return nil
+	}
+
+	if wcfg.RateLimit.DocumentsPerSecond < 0 || wcfg.RateLimit.BytesPerSecond < 0 {
+		log.Error("rate limits must be >= 0!")
+		return nil
+	}
+
+	if err := wcfg.Adaptive.validate(wcfg.BulkSize, wcfg.NumConsumers); err != nil {
+		log.Error("Invalid adaptive configuration", F("error", err))
+		return nil
+	}
+
+	if err := wcfg.Sync.validate(); err != nil {
+		log.Error("Invalid sync configuration", F("error", err))
+		return nil
+	}
+
+	if err := wcfg.Spool.validate(); err != nil {
+		log.Error("Invalid spool configuration", F("error", err))
+		return nil
+	}
+
+	if err := wcfg.Failover.validate(wcfg.Spool); err != nil {
+		log.Error("Invalid failover configuration", F("error", err))
+		return nil
+	}
+
+	if err := validateTargets(wcfg.Targets); err != nil {
+		log.Error("Invalid targets configuration", F("error", err))
+		return nil
+	}
+
+	// Inactive adaptive consumers would block their partition & pipelined bulks may be applied out of order
+	if wcfg.Partitioned && (wcfg.Adaptive.Enabled || wcfg.MaxInFlightPerConsumer > 1) {
+		log.Error("partitioned mode is incompatible with the adaptive mode & maxInFlightPerConsumer > 1")
+		return nil
+	}
+
+	idStrategy, err := newIDStrategy(wcfg)
+	if err != nil {
+		log.Error("Invalid ID strategy", F("error", err))
 		return nil
 	}
 
 	wg := &Workgroup{
 		cfg:               wcfg,
 		elasticURL:        esURL,
-		logger:            logger,
+		log:               log,
 		FailureOnDupIndex: true,
+		metrics:           nopMetrics{},
+		tracer:            nopTracer{},
+		events:            &eventBus{},
+		limiter:           newRateLimiter(wcfg.RateLimit),
 		p: &Producer{
-			pi: pi,
+			pi:         pi,
+			index:      wcfg.IndexName,
+			idStrategy: idStrategy,
 		},
 	}
 
@@ -68,12 +152,16 @@ func NewWorkgroup(esURL string, wcfg WorkgroupConfig, pi ProducerInterface, logg
 
 // SetOnProduceCallback define the callback to call when a document is produced
 // callback parameter is the current document produced count
+//
+// Deprecated: Subscribe to DocumentProduced events instead.
 func (w *Workgroup) SetOnProduceCallback(cb func(uint64)) {
 	w.p.onProduceCallback = cb
 }
 
 // SetOnProductionFinishedCallback define the callback to call when production is finished
 // callback parameter is the document produced count
+//
+// Deprecated: Subscribe to ProductionFinished events instead.
 func (w *Workgroup) SetOnProductionFinishedCallback(cb func(uint64)) {
 	w.p.onProductionFinishedCallback = cb
 }
@@ -84,20 +172,146 @@ func (w *Workgroup) SetStartupCallback(cb func() bool) {
 }
 
 // SetFailureCallback define the callback to call when the workgroup has a failure
+//
+// Deprecated: Subscribe to RunFailed events instead.
 func (w *Workgroup) SetFailureCallback(cb func()) {
 	w.onFailureCallback = cb
 }
 
 // SetFinishCallback define the callback to call when the workgroup has successfully finished
+//
+// Deprecated: Subscribe to RunFinished events instead.
 func (w *Workgroup) SetFinishCallback(cb func()) {
 	w.onFinishCallback = cb
 }
 
 // SetOnPushCallback define the callback to call when a bulk request has been pushed to Elasticsearch
+//
+// Deprecated: Subscribe to BulkSent events instead.
 func (w *Workgroup) SetOnPushCallback(cb func(int)) {
 	w.onPushCallback = cb
 }
 
+// SetOnAckCallback define a callback function called with the Ack tokens of the documents & their outcome,
+// in the same order, once their bulk request is done or given up. Documents rejected before being sent
+// or skipped by the incremental mode are passed on their own. Documents without Ack token have a nil one
+// & are left out when none has one. It is called by the consumers of the primary target, concurrently
+func (w *Workgroup) SetOnAckCallback(cb func(tokens []interface{}, results []AckResult)) {
+	w.onAckCallback = cb
+	w.p.onAckCallback = cb
+}
+
+// Subscribe registers fn to be called synchronously for each workgroup event
+// fn is called from the producer & consumers goroutines and must not block.
+// The returned function unsubscribes fn
+func (w *Workgroup) Subscribe(fn func(Event)) func() {
+	return w.events.subscribe(&eventSubscription{fn: fn})
+}
+
+// SubscribeChan returns a channel receiving workgroup events, buffered with buffer slots
+// Events are dropped while the buffer is full. The returned function unsubscribes
+// & closes the channel
+func (w *Workgroup) SubscribeChan(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	return ch, w.events.subscribe(&eventSubscription{ch: ch})
+}
+
+// SetHTTPClient define the HTTP client used to reach Elasticsearch
+// TLS & proxy connection settings are ignored when a custom HTTP client is set
+func (w *Workgroup) SetHTTPClient(c *http.Client) {
+	w.httpClient = c
+}
+
+// SetClient define the Elasticsearch client shared by the workgroup & its consumers
+// Connection configuration is ignored when a client is set
+func (w *Workgroup) SetClient(c *elastic.Client) {
+	w.client = c
+}
+
+// SetMetrics define the metrics collector fed by the producer & the consumers
+func (w *Workgroup) SetMetrics(m Metrics) {
+	if m == nil {
+		m = nopMetrics{}
+	}
+	w.metrics = m
+	w.p.metrics = m
+}
+
+// SetTracer define the tracer wrapping the workgroup phases & each bulk request
+// Trace context is propagated to Elasticsearch, unless the client is set with SetClient
+func (w *Workgroup) SetTracer(t Tracer) {
+	if t == nil {
+		t = nopTracer{}
+	}
+	w.tracer = t
+}
+
+// SetProgressCallback define the callback to call every interval with the run progress
+// If the ProducerInterface implements Sizer, snapshots include percent done & ETA
+func (w *Workgroup) SetProgressCallback(interval time.Duration, cb func(ProgressSnapshot)) {
+	w.progressInterval = interval
+	w.onProgressCallback = cb
+}
+
+// SetEncoder define the encoder of the documents Content, encoding/json is used by default
+// Documents with a RawContent are never encoded
+func (w *Workgroup) SetEncoder(e Encoder) {
+	w.encoder = e
+	w.p.encoder = e
+}
+
+// SetIDStrategy define how the IDs of the documents pushed without one are generated
+// It overrides the configured ID strategy
+func (w *Workgroup) SetIDStrategy(s IDStrategy) {
+	w.p.idStrategy = s
+}
+
+// SetFingerprintStore enables the incremental mode: documents indexed with the same content by
+// a previous run are skipped, & the fingerprints of the documents indexed are recorded in s
+func (w *Workgroup) SetFingerprintStore(s FingerprintStore) {
+	w.fingerprints = s
+	w.p.fingerprints = s
+}
+
+// SetFailoverJournal records the documents redirected to the failover cluster in j, so they can be
+// replayed to the primary cluster with a ReplayProducer
+func (w *Workgroup) SetFailoverJournal(j FailoverJournal) {
+	w.failoverJournal = j
+}
+
+// SetCheckpointStore saves in s the checkpoints of the producer whose documents are all indexed or
+// rejected for good, & resumes the producer from the saved checkpoint if the previous run didn't succeed
+// The producer must implement Resumer & the index is reused
+// The checkpoint is cleared once a run succeeds, unless documents failed for a transient reason
+func (w *Workgroup) SetCheckpointStore(s CheckpointStore) {
+	w.checkpoints = s
+}
+
+// SetRateLimit define the documents & bytes sent per second by all the consumers
+// It can be called while the workgroup is running, a zero value disables a limit
+func (w *Workgroup) SetRateLimit(l RateLimit) {
+	w.limiter.set(l)
+}
+
+// GetRateLimit returns the current rate limit
+func (w *Workgroup) GetRateLimit() RateLimit {
+	return w.limiter.get()
+}
+
+// SetRateLimitCallback define the callback to call every interval while running,
+// the rate limit it returns is applied to the consumers
+func (w *Workgroup) SetRateLimitCallback(interval time.Duration, cb func() RateLimit) {
+	w.rateLimitInterval = interval
+	w.onRateLimitCallback = cb
+}
+
+// SetStructuredLogger define the logger used instead of the one given to NewWorkgroup
+func (w *Workgroup) SetStructuredLogger(l StructuredLogger) {
+	if l != nil {
+		w.log = l
+	}
+}
+
 // SetIndexMapping define index mapping to apply just after index creation
 func (w *Workgroup) SetIndexMapping(mapping map[string]interface{}) {
 	w.indexMapping = mapping
@@ -108,12 +322,12 @@ func (w *Workgroup) SetIndexMapping(mapping map[string]interface{}) {
 func (w *Workgroup) SetIndexMappingFromFile(path string) bool {
 	bJSON, err := ioutil.ReadFile(path)
 	if err != nil {
-		w.logger.Errorf("Unable to read index mapping from file '%s': %v", path, err)
+		w.log.Error("Unable to read index mapping from file", F("file", path), F("error", err))
 		return false
 	}
 
 	if err := json.Unmarshal(bJSON, &w.indexMapping); err != nil {
-		w.logger.Errorf("Unable to unmarshal index mapping from file '%s': %v", path, err)
+		w.log.Error("Unable to unmarshal index mapping from file", F("file", path), F("error", err))
 		return false
 	}
 
@@ -125,116 +339,8 @@ func (w *Workgroup) GetIndexName() string {
 	return w.cfg.IndexName
 }
 
-// Run make the workgroup run
+// Run make the workgroup run & wait for it to finish
 func (w *Workgroup) Run() bool {
-	if w.onStartupCallback != nil {
-		// If startup callback has failed, stop immediately
-		if !w.onStartupCallback() {
-			if w.onFailureCallback != nil {
-				w.onFailureCallback()
-			}
-			return false
-		}
-	}
-
-	client, err := elastic.NewClient(
-		elastic.SetSniff(false),
-		elastic.SetURL(w.elasticURL),
-	)
-	if err != nil {
-		w.logger.Errorf("%v\n", err)
-		if w.onFailureCallback != nil {
-			w.onFailureCallback()
-		}
-		return false
-	}
-
-	tStart := time.Now()
-	n := 0
-
-	esConfig := IndexConfig{}
-	esConfig.Index.NumberOfReplicas = 0
-	esConfig.Index.RefreshInterval = "-1"
-	if _, err := client.CreateIndex(w.cfg.IndexName).Do(context.Background()); err != nil && w.FailureOnDupIndex {
-		w.logger.Errorf("Unable to create elasticsearch index '%s': %v", w.cfg.IndexName, err)
-		if w.onFailureCallback != nil {
-			w.onFailureCallback()
-		}
-		return false
-	}
-
-	if w.indexMapping != nil {
-		if _, err := client.PutMapping().Index(w.cfg.IndexName).Type(w.cfg.DocType).BodyJson(w.indexMapping).
-			Do(context.Background()); err != nil {
-			w.logger.Errorf("Unable to put elasticsearch index mapping on '%s': %v", w.cfg.IndexName, err)
-			if w.onFailureCallback != nil {
-				w.onFailureCallback()
-			}
-			return false
-		}
-	}
-
-	if _, err := client.IndexPutSettings(w.cfg.IndexName).BodyJson(esConfig).Do(context.Background()); err != nil {
-		w.logger.Errorf("Unable to put elasticsearch index settings on '%s': %v", w.cfg.IndexName, err)
-		if w.onFailureCallback != nil {
-			w.onFailureCallback()
-		}
-		return false
-	}
-
-	// Create the production wait group
-	wgProduce := &sync.WaitGroup{}
-	cDoc := make(chan *Document, w.cfg.ChannelBufferSize)
-
-	// Configure & start the producer
-	wgProduce.Add(1)
-	w.p.setChannelAndWaitGroup(cDoc, wgProduce)
-	go w.p.produce()
-
-	// Create the consuming wait group & start consuming
-	wgConsume := &sync.WaitGroup{}
-	for i := 0; i < w.cfg.NumConsumers; i++ {
-		wgConsume.Add(1)
-		c := Consumer{
-			BulkSize:   w.cfg.BulkSize,
-			ElasticURL: w.elasticURL,
-			DocType:    w.cfg.DocType,
-			Index:      w.cfg.IndexName,
-			logger:     w.logger,
-		}
-
-		// Set the consumer callback function if defined on the workgroup
-		if w.onPushCallback != nil {
-			c.onPushCallback = w.onPushCallback
-		}
-
-		go c.Consume(cDoc, wgConsume)
-	}
-
-	wgProduce.Wait()
-	// Production finished, closing the channel
-	close(cDoc)
-
-	// Now finishing to consume
-	wgConsume.Wait()
-
-	// Re-set ES index standard configs
-	esConfig.Index.NumberOfReplicas = 1
-	esConfig.Index.RefreshInterval = "10s"
-	if _, err := client.IndexPutSettings(w.cfg.IndexName).BodyJson(esConfig).Do(context.Background()); err != nil {
-		w.logger.Errorf("Unable to put elasticsearch index settings.")
-		if w.onFailureCallback != nil {
-			w.onFailureCallback()
-		}
-		return false
-	}
-
-	if w.onFinishCallback != nil {
-		w.onFinishCallback()
-	}
-
-	tEnd := time.Now()
-	elapsed := tEnd.Sub(tStart)
-	w.logger.Infof("%d documents indexed in %s (bulksize: %d).", n, elapsed.String(), w.cfg.BulkSize)
-	return true
+	_, err := w.Start(context.Background()).Wait()
+	return err == nil
 }
@@ -2,7 +2,10 @@ package elasticwg
 
 import (
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
 	"testing"
+	"time"
 )
 
 type testProducer struct {
@@ -111,6 +114,40 @@ func TestNewWorkgroup(t *testing.T) {
 
 	cfg.NumConsumers = 10
 	cfg.BulkSize = 500
+	cfg.Compression = "zstd"
+	assert.Nil(t, NewWorkgroup(
+		esURL,
+		cfg,
+		&testProducer{},
+		gTestLogger),
+	)
+
+	cfg.NumConsumers = 10
+	cfg.BulkSize = 500
+	cfg.Compression = CompressionGzip
+	cfg.Partitioned = true
+	cfg.MaxInFlightPerConsumer = 2
+	assert.Nil(t, NewWorkgroup(
+		esURL,
+		cfg,
+		&testProducer{},
+		gTestLogger),
+	)
+
+	cfg.NumConsumers = 10
+	cfg.BulkSize = 500
+	cfg.MaxInFlightPerConsumer = 0
+	cfg.IDStrategy = IDStrategyTemplate
+	assert.Nil(t, NewWorkgroup(
+		esURL,
+		cfg,
+		&testProducer{},
+		gTestLogger),
+	)
+
+	cfg.NumConsumers = 10
+	cfg.BulkSize = 500
+	cfg.IDTemplate = "{name}"
 	assert.NotNil(t, NewWorkgroup(
 		esURL,
 		cfg,
@@ -199,3 +236,44 @@ func TestWorkgroup_SetStartupCallback(t *testing.T) {
 
 	assert.NotNil(t, wg.onStartupCallback)
 }
+
+func TestWorkgroup_SetHTTPClient(t *testing.T) {
+	wg := NewWorkgroup(esURL, testCfg, &testProducer{}, gTestLogger)
+	wg.SetHTTPClient(&http.Client{})
+
+	assert.NotNil(t, wg.httpClient)
+}
+
+func TestWorkgroup_SetClient(t *testing.T) {
+	wg := NewWorkgroup(esURL, testCfg, &testProducer{}, gTestLogger)
+	wg.SetClient(&elastic.Client{})
+
+	assert.NotNil(t, wg.client)
+}
+
+func TestWorkgroup_SetMetrics(t *testing.T) {
+	wg := NewWorkgroup(esURL, testCfg, &testProducer{}, gTestLogger)
+	assert.Equal(t, nopMetrics{}, wg.metrics)
+
+	wg.SetMetrics(nil)
+	assert.Equal(t, nopMetrics{}, wg.metrics)
+	assert.Equal(t, nopMetrics{}, wg.p.metrics)
+}
+
+func TestWorkgroup_SetRateLimit(t *testing.T) {
+	cfg := testCfg
+	cfg.RateLimit.DocumentsPerSecond = -1
+	assert.Nil(t, NewWorkgroup(esURL, cfg, &testProducer{}, gTestLogger))
+
+	cfg.RateLimit.DocumentsPerSecond = 5000
+	wg := NewWorkgroup(esURL, cfg, &testProducer{}, gTestLogger)
+	assert.Equal(t, RateLimit{DocumentsPerSecond: 5000}, wg.GetRateLimit())
+
+	wg.SetRateLimit(RateLimit{BytesPerSecond: 1 << 20})
+	assert.Equal(t, RateLimit{BytesPerSecond: 1 << 20}, wg.GetRateLimit())
+
+	wg.SetRateLimitCallback(time.Minute, func() RateLimit {
+		return RateLimit{}
+	})
+	assert.NotNil(t, wg.onRateLimitCallback)
+}
@@ -0,0 +1,44 @@
+// Package zapwg adapts a zap logger to elasticwg.StructuredLogger
+package zapwg
+
+import (
+	"gitlab.com/thundersnake/elasticwg"
+	"go.uber.org/zap"
+)
+
+type logger struct {
+	logger *zap.Logger
+}
+
+// New wraps l into an elasticwg.StructuredLogger
+func New(l *zap.Logger) elasticwg.StructuredLogger {
+	return &logger{logger: l}
+}
+
+func zapFields(fields []elasticwg.Field) []zap.Field {
+	z := make([]zap.Field, len(fields))
+	for i, f := range fields {
+		z[i] = zap.Any(f.Key, f.Value)
+	}
+	return z
+}
+
+func (l *logger) Debug(msg string, fields ...elasticwg.Field) {
+	l.logger.Debug(msg, zapFields(fields)...)
+}
+
+func (l *logger) Info(msg string, fields ...elasticwg.Field) {
+	l.logger.Info(msg, zapFields(fields)...)
+}
+
+func (l *logger) Warn(msg string, fields ...elasticwg.Field) {
+	l.logger.Warn(msg, zapFields(fields)...)
+}
+
+func (l *logger) Error(msg string, fields ...elasticwg.Field) {
+	l.logger.Error(msg, zapFields(fields)...)
+}
+
+func (l *logger) With(fields ...elasticwg.Field) elasticwg.StructuredLogger {
+	return &logger{logger: l.logger.With(zapFields(fields)...)}
+}
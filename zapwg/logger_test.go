@@ -0,0 +1,24 @@
+package zapwg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/thundersnake/elasticwg"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	l := New(zap.New(core))
+
+	l.With(elasticwg.F("index", "idx")).Error("Unable to create elasticsearch index", elasticwg.F("run_id", "42"))
+	l.Debug("hidden")
+
+	entries := logs.All()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, zapcore.ErrorLevel, entries[0].Level)
+	assert.Equal(t, "Unable to create elasticsearch index", entries[0].Message)
+	assert.Equal(t, map[string]interface{}{"index": "idx", "run_id": "42"}, entries[0].ContextMap())
+}